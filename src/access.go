@@ -0,0 +1,142 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Access - what an access rule does to the events it matches
+type Access int
+
+const (
+	ACCESS_ALLOW Access = iota // bypass every limit
+	ACCESS_DENY                // always reject
+)
+
+// IP_LABEL - the event label that CIDR access rules are matched against
+const IP_LABEL = "ip"
+
+// AccessRule - allowlist / denylist entry, decided before any counter is touched.
+// Matches an exact client id or a CIDR range, denies win over allows.
+type AccessRule struct {
+	id        string
+	access    Access
+	clientId  string    // exact client id, or
+	cidr      string    // an IPv4 or IPv6 range, e.g. 10.0.0.0/8 or 2001:db8::/32
+	expiresAt time.Time // optional. the rule stops applying from then on
+}
+
+// accessEntry - an access rule with its range parsed
+type accessEntry struct {
+	rule    AccessRule
+	network *net.IPNet
+}
+
+func (ar AccessRule) parse() (accessEntry, error) {
+	if ar.access != ACCESS_ALLOW && ar.access != ACCESS_DENY {
+		return accessEntry{}, fmt.Errorf("access rule %s: unknown access %d", ar.id, ar.access)
+	}
+	if (ar.clientId == "") == (ar.cidr == "") {
+		return accessEntry{}, fmt.Errorf("access rule %s: needs either a client id or a cidr", ar.id)
+	}
+	entry := accessEntry{rule: ar}
+	if ar.cidr != "" {
+		_, network, err := net.ParseCIDR(ar.cidr)
+		if err != nil {
+			return accessEntry{}, fmt.Errorf("access rule %s: %v", ar.id, err)
+		}
+		entry.network = network
+	}
+	return entry, nil
+}
+
+func (e accessEntry) matches(inst Event, ip net.IP, now time.Time) bool {
+	if !e.rule.expiresAt.IsZero() && !now.Before(e.rule.expiresAt) {
+		return false
+	}
+	if e.network != nil {
+		return ip != nil && e.network.Contains(ip)
+	}
+	return e.rule.clientId == inst.clientId
+}
+
+// checkAccess - finds the access rule deciding the event, if any. Denies take precedence over allows.
+func (r *ApiRateLimiter) checkAccess(inst Event) (AccessRule, bool) {
+	r.rulesLock.RLock()
+	defer r.rulesLock.RUnlock()
+	if len(r.accessRules) == 0 {
+		return AccessRule{}, false
+	}
+	ip := net.ParseIP(inst.labels[IP_LABEL])
+	now := r.eventTime(inst)
+	var allowed *AccessRule
+	for i := range r.accessRules {
+		entry := r.accessRules[i]
+		if !entry.matches(inst, ip, now) {
+			continue
+		}
+		if entry.rule.access == ACCESS_DENY {
+			return entry.rule, true
+		}
+		if allowed == nil {
+			allowed = &r.accessRules[i].rule
+		}
+	}
+	if allowed != nil {
+		return *allowed, true
+	}
+	return AccessRule{}, false
+}
+
+func parseAccessRules(ars []AccessRule) ([]accessEntry, error) {
+	entries := []accessEntry{}
+	for _, ar := range ars {
+		entry, err := ar.parse()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AddAccessRules - adds the given allow / deny rules, replacing the existing ones with the same id.
+// Nothing is applied if any of them is invalid.
+func (r *ApiRateLimiter) AddAccessRules(ars []AccessRule) error {
+	entries, err := parseAccessRules(ars)
+	if err != nil {
+		return err
+	}
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	replaced := make(map[string]bool)
+	for _, entry := range entries {
+		replaced[entry.rule.id] = true
+	}
+	remaining := []accessEntry{}
+	for _, entry := range r.accessRules {
+		if !replaced[entry.rule.id] {
+			remaining = append(remaining, entry)
+		}
+	}
+	r.accessRules = append(remaining, entries...)
+	return nil
+}
+
+// RemoveAccessRules - removes the given allow / deny rules
+func (r *ApiRateLimiter) RemoveAccessRules(ids ...string) {
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	removed := make(map[string]bool)
+	for _, id := range ids {
+		removed[id] = true
+	}
+	remaining := []accessEntry{}
+	for _, entry := range r.accessRules {
+		if !removed[entry.rule.id] {
+			remaining = append(remaining, entry)
+		}
+	}
+	r.accessRules = remaining
+}
@@ -1,5 +1,14 @@
 package cache
 
+import "time"
+
 type Store interface {
-	IncrAndGet(key string) int 
-}
\ No newline at end of file
+	IncrAndGet(key string) int
+	IncrByAndGet(key string, value int) int
+	DecrByAndGet(key string, value int) int
+	// plain values with their own TTL, for state that isn't a counter (e.g. bans)
+	Put(key string, value string, ttl time.Duration)
+	Get(key string) (string, bool)
+	Delete(key string)
+	Keys(prefix string) []string
+}
@@ -0,0 +1,490 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"../logging"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// GossipConfig - peers send their sync messages straight to each other, without redis. Every node sends
+// to the seeds, and to the peers it has heard of, from them or from the peers they know of.
+// Gossip is neither authenticated nor encrypted: whoever reaches BindAddr can add to the counts, or join
+// the fleet by listing itself as a peer. It must only be reachable from the network of the fleet
+type GossipConfig struct {
+	// BindAddr - the host:port to listen on, e.g. ":7946"
+	BindAddr string
+	// Seeds - host:port of the peers to start from. Names are resolved again before every send, so a DNS
+	// name with a record per node stands for the whole fleet. The node's own address may be among them
+	Seeds []string
+	// Network - "udp" or "tcp". Defaults to udp
+	Network string
+	// AdvertisePort - the port the peers reach this node on, when it is not the one of BindAddr, e.g. behind a NAT
+	AdvertisePort int
+	// PeerTimeout - a peer that has sent nothing for this long is no longer sent to, unless it is a seed.
+	// Defaults to 30 seconds
+	PeerTimeout time.Duration
+	// BufferSize - received messages waiting for SyncedMemory. When it is full messages are dropped, and
+	// the sequence gaps get their senders to send snapshots. Defaults to 4096
+	BufferSize int
+	Logger     *slog.Logger // optional, defaults to slog.Default()
+}
+
+const (
+	GOSSIP_UDP string = "udp"
+	GOSSIP_TCP string = "tcp"
+)
+
+const (
+	maxDatagramSize   = 65000 // below the 65507 bytes a UDP datagram can carry
+	maxGossipPayload  = 48 * 1024
+	maxStreamFrame    = 16 * 1024 * 1024 // a longer TCP frame is garbage, its connection is dropped
+	maxStreamPayload  = 8 * 1024 * 1024
+	gossipDialTimeout = time.Second
+	// the wait after failed reads in a row, doubling up to the max
+	gossipMinBackoff = 10 * time.Millisecond
+	gossipMaxBackoff = time.Second
+)
+
+var errTransportClosed = errors.New("transport closed")
+
+// gossipFrame - what goes over the wire. The sender is known by the address the frame came from, with Port
+// in place of its source port
+type gossipFrame struct {
+	ID       string   `msgpack:"id"` // tells a node its own frames apart
+	Port     int      `msgpack:"p"`
+	SentAt   int64    `msgpack:"t"` // unix nanos
+	Peers    []string `msgpack:"a,omitempty"`
+	Payloads [][]byte `msgpack:"m,omitempty"`
+}
+
+type gossipPeer struct {
+	lastHeard time.Time
+	direct    bool // heard from, rather than of. only these are gossiped on, so that departed peers are forgotten
+}
+
+type gossipTransport struct {
+	config    GossipConfig
+	id        string
+	port      int
+	incoming  chan Received
+	peers     map[string]*gossipPeer // by address
+	self      map[string]struct{}    // addresses our own frames came back from
+	peersLock sync.Mutex
+	// set once connected
+	packetConn net.PacketConn
+	listener   net.Listener
+	done       chan struct{}
+	closeOnce  sync.Once
+	connLock   sync.Mutex
+}
+
+// NewGossipTransport - syncs the nodes without redis. Without a store of the past messages there is no
+// replay: a joining node asks its peers for snapshots as their deltas reach it
+func NewGossipTransport(config GossipConfig) (Transport, error) {
+	if config.Network == "" {
+		config.Network = GOSSIP_UDP
+	}
+	if config.Network != GOSSIP_UDP && config.Network != GOSSIP_TCP {
+		return nil, fmt.Errorf("gossip network must be %s or %s, got %s", GOSSIP_UDP, GOSSIP_TCP, config.Network)
+	}
+	if _, _, err := net.SplitHostPort(config.BindAddr); err != nil {
+		return nil, fmt.Errorf("invalid gossip bind address %s: %w", config.BindAddr, err)
+	}
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = 30 * time.Second
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 4096
+	}
+	config.Logger = logging.OrDefault(config.Logger).With("transport", "gossip", "bind_addr", config.BindAddr)
+	return &gossipTransport{
+		config:   config,
+		id:       uuid.NewString(),
+		incoming: make(chan Received, config.BufferSize),
+		peers:    make(map[string]*gossipPeer),
+		self:     make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Connect - starts listening. There is nothing to replay
+func (t *gossipTransport) Connect(replay time.Duration) error {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.packetConn != nil || t.listener != nil {
+		return nil
+	}
+	var addr net.Addr
+	if t.config.Network == GOSSIP_UDP {
+		conn, err := net.ListenPacket("udp", t.config.BindAddr)
+		if err != nil {
+			return err
+		}
+		t.packetConn = conn
+		addr = conn.LocalAddr()
+		go t.receivePackets(conn)
+	} else {
+		listener, err := net.Listen("tcp", t.config.BindAddr)
+		if err != nil {
+			return err
+		}
+		t.listener = listener
+		addr = listener.Addr()
+		go t.accept(listener)
+	}
+	t.port = t.config.AdvertisePort
+	if t.port == 0 {
+		_, port, _ := net.SplitHostPort(addr.String())
+		t.port, _ = strconv.Atoi(port)
+	}
+	t.config.Logger.Info("gossip listening", "network", t.config.Network, "addr", addr.String(), "seeds", t.config.Seeds)
+	return nil
+}
+
+// Publish - sends the messages to every seed and known peer. It fails only when none of them could be sent to
+func (t *gossipTransport) Publish(payloads [][]byte) error {
+	select {
+	case <-t.done:
+		return errTransportClosed
+	default:
+	}
+	t.connLock.Lock()
+	connected := t.packetConn != nil || t.listener != nil
+	t.connLock.Unlock()
+	if !connected {
+		return errors.New("gossip transport not connected")
+	}
+	targets := t.targets()
+	if len(targets) == 0 {
+		return nil
+	}
+	frames, err := t.frames(payloads)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	sent := 0
+	for _, target := range targets {
+		if err := t.send(target, frames); err != nil {
+			t.config.Logger.Debug("unable to gossip to peer", "peer", target, "error", err)
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("unable to gossip to any of %d peers: %w", len(targets), lastErr)
+	}
+	return nil
+}
+
+// Receive - the messages that arrived since the last call
+func (t *gossipTransport) Receive(timeout time.Duration) ([]Received, error) {
+	received := []Received{}
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case r := <-t.incoming:
+			received = append(received, r)
+		case <-timer.C:
+			return received, nil
+		case <-t.done:
+			return nil, errTransportClosed
+		}
+	}
+	for {
+		select {
+		case r := <-t.incoming:
+			received = append(received, r)
+		default:
+			return received, nil
+		}
+	}
+}
+
+func (t *gossipTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.packetConn != nil {
+		return t.packetConn.Close()
+	}
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+// targets - the seeds, freshly resolved, and the peers heard from within PeerTimeout
+func (t *gossipTransport) targets() []string {
+	targets := map[string]struct{}{}
+	for _, seed := range t.config.Seeds {
+		for _, addr := range t.resolve(seed) {
+			targets[addr] = struct{}{}
+		}
+	}
+	t.peersLock.Lock()
+	now := time.Now()
+	for addr, peer := range t.peers {
+		if now.Sub(peer.lastHeard) > t.config.PeerTimeout {
+			delete(t.peers, addr)
+			continue
+		}
+		targets[addr] = struct{}{}
+	}
+	for addr := range t.self {
+		delete(targets, addr)
+	}
+	t.peersLock.Unlock()
+	addrs := make([]string, 0, len(targets))
+	for addr := range targets {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// resolve - the addresses a seed stands for
+func (t *gossipTransport) resolve(seed string) []string {
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		t.config.Logger.Warn("ignoring invalid seed", "seed", seed, "error", err)
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{seed}
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		t.config.Logger.Debug("unable to resolve seed", "seed", seed, "error", err)
+		return nil
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs
+}
+
+// knownPeers - the addresses gossiped along with the messages
+func (t *gossipTransport) knownPeers() []string {
+	t.peersLock.Lock()
+	defer t.peersLock.Unlock()
+	peers := make([]string, 0, len(t.peers))
+	for addr, peer := range t.peers {
+		if peer.direct {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// frames - encodes the messages, split up to fit in datagrams over UDP, and in frames the peers accept over TCP
+func (t *gossipTransport) frames(payloads [][]byte) ([][]byte, error) {
+	frame := gossipFrame{ID: t.id, Port: t.port, SentAt: time.Now().UnixNano(), Peers: t.knownPeers()}
+	maxPayload, maxFrame := maxGossipPayload, maxDatagramSize
+	if t.config.Network == GOSSIP_TCP {
+		maxPayload, maxFrame = maxStreamPayload, maxStreamFrame
+	}
+	frames := [][]byte{}
+	size := 0
+	for i, payload := range payloads {
+		if len(payload) > maxPayload {
+			return nil, fmt.Errorf("sync message of %d bytes does not fit in a gossip frame", len(payload))
+		}
+		frame.Payloads = append(frame.Payloads, payload)
+		size += len(payload)
+		if i+1 < len(payloads) && size+len(payloads[i+1]) <= maxPayload {
+			continue
+		}
+		b, err := msgpack.Marshal(&frame)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxFrame {
+			// a long peer list. the next frames go without it
+			frame.Peers = nil
+			if b, err = msgpack.Marshal(&frame); err != nil {
+				return nil, err
+			}
+		}
+		frames = append(frames, b)
+		frame.Payloads = nil
+		size = 0
+	}
+	if len(frames) == 0 {
+		b, err := msgpack.Marshal(&frame)
+		return [][]byte{b}, err
+	}
+	return frames, nil
+}
+
+func (t *gossipTransport) send(target string, frames [][]byte) error {
+	if t.config.Network == GOSSIP_UDP {
+		addr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			return err
+		}
+		for _, frame := range frames {
+			if _, err := t.packetConn.WriteTo(frame, addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", target, gossipDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(gossipDialTimeout))
+	w := bufio.NewWriter(conn)
+	for _, frame := range frames {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+		w.Write(length[:])
+		w.Write(frame)
+	}
+	return w.Flush()
+}
+
+func (t *gossipTransport) receivePackets(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	failures := 0
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			failures++
+			if !t.backOff("read", failures, err) {
+				return
+			}
+			continue
+		}
+		t.recovered("read", failures)
+		failures = 0
+		t.handleFrame(append([]byte(nil), buf[:n]...), addr.(*net.UDPAddr).IP)
+	}
+}
+
+func (t *gossipTransport) accept(listener net.Listener) {
+	failures := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			failures++
+			if !t.backOff("accept", failures, err) {
+				return
+			}
+			continue
+		}
+		t.recovered("accept", failures)
+		failures = 0
+		go t.receiveStream(conn)
+	}
+}
+
+// backOff - waits before trying again after the given number of failures in a row, logging the first one
+// only. It reports false once the transport is closed
+func (t *gossipTransport) backOff(operation string, failures int, err error) bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	if failures == 1 {
+		t.config.Logger.Warn("unable to "+operation+" gossip, backing off", "error", err)
+	}
+	wait := gossipMinBackoff
+	for i := 1; i < failures && wait < gossipMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > gossipMaxBackoff {
+		wait = gossipMaxBackoff
+	}
+	select {
+	case <-t.done:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// recovered - logs the end of a streak of failures
+func (t *gossipTransport) recovered(operation string, failures int) {
+	if failures > 0 {
+		t.config.Logger.Info("able to "+operation+" gossip again", "failures", failures)
+	}
+}
+
+// receiveStream - reads the length prefixed frames of a connection until the sender closes it
+func (t *gossipTransport) receiveStream(conn net.Conn) {
+	defer conn.Close()
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(gossipDialTimeout))
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxStreamFrame {
+			// not one of ours. there is no telling where the next frame starts
+			t.config.Logger.Warn("oversized gossip frame, closing the connection", "peer", ip.String(), "size", size)
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.config.Logger.Debug("truncated gossip frame", "peer", ip.String(), "error", err)
+			return
+		}
+		t.handleFrame(frame, ip)
+	}
+}
+
+// handleFrame - learns of the sender and the peers it knows, and queues its messages
+func (t *gossipTransport) handleFrame(b []byte, ip net.IP) {
+	var frame gossipFrame
+	if err := msgpack.Unmarshal(b, &frame); err != nil {
+		t.config.Logger.Debug("ignoring invalid gossip frame", "peer", ip.String(), "error", err)
+		return
+	}
+	sender := net.JoinHostPort(ip.String(), strconv.Itoa(frame.Port))
+	t.peersLock.Lock()
+	if frame.ID == t.id {
+		t.self[sender] = struct{}{}
+		delete(t.peers, sender)
+		t.peersLock.Unlock()
+		return
+	}
+	t.peers[sender] = &gossipPeer{lastHeard: time.Now(), direct: true}
+	for _, addr := range frame.Peers {
+		if _, ok := t.self[addr]; ok {
+			continue
+		}
+		if _, ok := t.peers[addr]; !ok {
+			// heard of, not from. it is dropped after PeerTimeout unless it gets in touch
+			t.peers[addr] = &gossipPeer{lastHeard: time.Now()}
+		}
+	}
+	t.peersLock.Unlock()
+	sentAt := time.Unix(0, frame.SentAt)
+	for _, payload := range frame.Payloads {
+		select {
+		case t.incoming <- Received{Payload: payload, SentAt: sentAt}:
+		default:
+			t.config.Logger.Debug("gossip buffer full, dropping a message", "peer", sender)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"time"
+
+	"../metrics"
+)
+
+// instrumentedStore - reports the latency of every operation of the store it wraps
+type instrumentedStore struct {
+	store   Store
+	name    string
+	metrics metrics.Collector
+}
+
+// NewInstrumentedStore - wraps the store so that the collector sees every operation, labelled with the given name
+func NewInstrumentedStore(store Store, name string, collector metrics.Collector) Store {
+	return &instrumentedStore{store: store, name: name, metrics: collector}
+}
+
+func (s *instrumentedStore) observe(operation string, start time.Time) {
+	s.metrics.ObserveStoreOperation(s.name, operation, time.Since(start))
+}
+
+func (s *instrumentedStore) IncrAndGet(key string) int {
+	defer s.observe("incr", time.Now())
+	return s.store.IncrAndGet(key)
+}
+
+func (s *instrumentedStore) IncrByAndGet(key string, value int) int {
+	defer s.observe("incr", time.Now())
+	return s.store.IncrByAndGet(key, value)
+}
+
+func (s *instrumentedStore) DecrByAndGet(key string, value int) int {
+	defer s.observe("decr", time.Now())
+	return s.store.DecrByAndGet(key, value)
+}
+
+func (s *instrumentedStore) Put(key string, value string, ttl time.Duration) {
+	defer s.observe("put", time.Now())
+	s.store.Put(key, value, ttl)
+}
+
+func (s *instrumentedStore) Get(key string) (string, bool) {
+	defer s.observe("get", time.Now())
+	return s.store.Get(key)
+}
+
+func (s *instrumentedStore) Delete(key string) {
+	defer s.observe("delete", time.Now())
+	s.store.Delete(key)
+}
+
+func (s *instrumentedStore) Keys(prefix string) []string {
+	defer s.observe("keys", time.Now())
+	return s.store.Keys(prefix)
+}
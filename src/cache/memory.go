@@ -1,9 +1,13 @@
 package cache
 
 import (
-	"fmt"
+	"log/slog"
 	"strconv"
 	"time"
+
+	"../clock"
+	"../logging"
+	"../types"
 )
 
 type Cache struct {
@@ -12,6 +16,10 @@ type Cache struct {
 	// internal fields
 	lastCleaned     string
 	cleanupInterval time.Duration
+	nextCleanup     time.Time
+	clock           clock.Clock
+	logger          *slog.Logger
+	values          *types.Map
 }
 
 func max(x, y int) int {
@@ -21,40 +29,69 @@ func max(x, y int) int {
 	return y
 }
 
+// CacheConfig - the optional dependencies of a Cache
+type CacheConfig struct {
+	Clock  clock.Clock  // optional, defaults to the system clock. cleanups follow it
+	Logger *slog.Logger // optional, defaults to slog.Default(). cleanups are logged at debug level
+}
+
 func NewCache(reloadInterval time.Duration) *Cache {
+	return NewCacheWithConfig(reloadInterval, CacheConfig{})
+}
+
+// NewCacheWithConfig - same as NewCache, with the dependencies in CacheConfig
+func NewCacheWithConfig(reloadInterval time.Duration, config CacheConfig) *Cache {
+	clk := clock.OrSystem(config.Clock)
 	var newInstance *Cache = &Cache{
 		cacheMapA:       make(map[string]string),
 		cacheMapB:       make(map[string]string),
 		cleanupInterval: reloadInterval, // sufficiently larger value to ensure that we don't delete live data
 		lastCleaned:     "A",
+		clock:           clk,
+		logger:          logging.OrDefault(config.Logger),
+		values:          types.NewMapWithClock(clk),
 	}
-	go newInstance.cleaner()
+	newInstance.nextCleanup = clk.Now().Truncate(time.Second).Add(reloadInterval)
 	return newInstance
 }
 
-func (c *Cache) cleaner() {
-	nextTime := time.Now().Truncate(time.Second)
-	nextTime = nextTime.Add(c.cleanupInterval)
-	time.Sleep(time.Until(nextTime))
-	fmt.Println("Performing cleanup now: ", time.Now())
-	if c.lastCleaned == "A" {
-		c.cacheMapB = make(map[string]string)
-		fmt.Println("Cleaned up B")
-		c.lastCleaned = "B"
-	} else {
-		c.cacheMapA = make(map[string]string)
-		fmt.Println("Cleaned up A")
-		c.lastCleaned = "A"
+// cleanupIfDue - performs every cleanup that has fallen due since the last access
+func (c *Cache) cleanupIfDue() {
+	now := c.clock.Now()
+	for ; !now.Before(c.nextCleanup); c.nextCleanup = c.nextCleanup.Add(c.cleanupInterval) {
+		if c.lastCleaned == "A" {
+			c.cacheMapB = make(map[string]string)
+			c.lastCleaned = "B"
+		} else {
+			c.cacheMapA = make(map[string]string)
+			c.lastCleaned = "A"
+		}
+		c.logger.Debug("cache cleanup", "cleared", c.lastCleaned, "at", now)
 	}
-	go c.cleaner()
 }
 
 func (c *Cache) IncrAndGet(key string) int {
+	return c.IncrByAndGet(key, 1)
+}
+
+// IncrByAndGet - increments the counter by the given value and returns the new count
+func (c *Cache) IncrByAndGet(key string, value int) int {
+	c.cleanupIfDue()
 	i1 := getAsInt(c.cacheMapA, key, 0)
 	i2 := getAsInt(c.cacheMapB, key, 0)
 	i := max(i1, i2)
-	c.put(key, strconv.Itoa(i+1))
-	return i + 1
+	c.put(key, strconv.Itoa(i+value))
+	return i + value
+}
+
+// DecrByAndGet - gives back the given value, never taking the counter below zero
+func (c *Cache) DecrByAndGet(key string, value int) int {
+	c.cleanupIfDue()
+	i1 := getAsInt(c.cacheMapA, key, 0)
+	i2 := getAsInt(c.cacheMapB, key, 0)
+	i := max(max(i1, i2)-value, 0)
+	c.put(key, strconv.Itoa(i))
+	return i
 }
 
 func (c *Cache) put(key string, value string) {
@@ -70,3 +107,20 @@ func getAsInt(cacheMap map[string]string, key string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func (c *Cache) Put(key string, value string, ttl time.Duration) {
+	c.values.Put(key, value, ttl)
+}
+
+func (c *Cache) Get(key string) (string, bool) {
+	val, resCode := c.values.Get(key)
+	return val, resCode == types.HIT
+}
+
+func (c *Cache) Delete(key string) {
+	c.values.Delete(key)
+}
+
+func (c *Cache) Keys(prefix string) []string {
+	return c.values.Keys(prefix)
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"strings"
+	"time"
+)
+
+// namespacedStore - prefixes every key of the store it wraps, so that limiters sharing a Redis keep apart
+type namespacedStore struct {
+	store  Store
+	prefix string
+}
+
+// NewNamespacedStore - keys are stored as "<namespace>:<key>". Keys returns them without the prefix
+func NewNamespacedStore(store Store, namespace string) Store {
+	return &namespacedStore{store: store, prefix: namespace + ":"}
+}
+
+func (s *namespacedStore) IncrAndGet(key string) int {
+	return s.store.IncrAndGet(s.prefix + key)
+}
+
+func (s *namespacedStore) IncrByAndGet(key string, value int) int {
+	return s.store.IncrByAndGet(s.prefix+key, value)
+}
+
+func (s *namespacedStore) DecrByAndGet(key string, value int) int {
+	return s.store.DecrByAndGet(s.prefix+key, value)
+}
+
+func (s *namespacedStore) Put(key string, value string, ttl time.Duration) {
+	s.store.Put(s.prefix+key, value, ttl)
+}
+
+func (s *namespacedStore) Get(key string) (string, bool) {
+	return s.store.Get(s.prefix + key)
+}
+
+func (s *namespacedStore) Delete(key string) {
+	s.store.Delete(s.prefix + key)
+}
+
+func (s *namespacedStore) Keys(prefix string) []string {
+	keys := s.store.Keys(s.prefix + prefix)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+	return keys
+}
@@ -65,29 +65,35 @@ func (r *redisStore) checkIfExists(key string) types.ResultCode {
 	}
 }
 
-func (r *redisStore) setTtlIfRequired(key string) int {
+// setTtlIfRequired - creates the key with the given value and a TTL if it doesn't exist yet.
+// Returns true if the key was created by this call.
+func (r *redisStore) setTtlIfRequired(key string, value int) bool {
 	_, ok := r.checkMap.Get(key)
 	if ok != types.HIT {
 		// its a miss. we need to check Redis
 		resultCode := r.checkIfExists(key)
 		if resultCode != types.HIT {
-			// doesn't exist in redis
-			r.client.SetXX(key, 1, getMaxAllowedTime())
+			// doesn't exist in redis. another node may still beat us to it
+			created, err := r.client.SetNX(key, value, getMaxAllowedTime()).Result()
 			r.checkMap.Put(key, "0", getMaxAllowedTime())
-			return 1
+			return err == nil && created
 		}
-		return 0
+		return false
 	}
-	return 0
+	return false
 }
 
 func (r *redisStore) IncrAndGet(key string) int {
-	result := r.setTtlIfRequired(key)
-	if result == 1 {
+	return r.IncrByAndGet(key, 1)
+}
+
+// IncrByAndGet - increments the counter by the given value and returns the new count
+func (r *redisStore) IncrByAndGet(key string, value int) int {
+	if r.setTtlIfRequired(key, value) {
 		// new entrant
-		return result
+		return value
 	}
-	val, err := r.client.Incr(key).Result()
+	val, err := r.client.IncrBy(key, int64(value)).Result()
 	if err != nil {
 		// something went wrong
 		// we will swallow the error and respond with 0
@@ -96,3 +102,60 @@ func (r *redisStore) IncrAndGet(key string) int {
 		return int(val)
 	}
 }
+
+// DecrByAndGet - gives back the given value. A counter that would drop below zero (e.g. it has already
+// expired) is removed instead, so that redis doesn't keep a negative key around without a TTL.
+func (r *redisStore) DecrByAndGet(key string, value int) int {
+	val, err := r.client.DecrBy(key, int64(value)).Result()
+	if err != nil {
+		// swallow the error, same as IncrByAndGet
+		return 0
+	}
+	if val < 0 {
+		r.client.Del(key)
+		return 0
+	}
+	return int(val)
+}
+
+func (r *redisStore) Put(key string, value string, ttl time.Duration) {
+	r.client.Set(key, value, ttl)
+}
+
+func (r *redisStore) Get(key string) (string, bool) {
+	return getValue(r.client, key)
+}
+
+func (r *redisStore) Delete(key string) {
+	r.client.Del(key)
+}
+
+func (r *redisStore) Keys(prefix string) []string {
+	return scanKeys(r.client, prefix)
+}
+
+// getValue - reads a plain value. errors are swallowed and reported as a miss
+func getValue(client *redis.Client, key string) (string, bool) {
+	val, err := client.Get(key).Result()
+	if err != nil {
+		return "", false
+	}
+	return val, true
+}
+
+// scanKeys - lists the keys with the given prefix without blocking redis the way KEYS would
+func scanKeys(client *redis.Client, prefix string) []string {
+	keys := []string{}
+	var cursor uint64
+	for {
+		batch, next, err := client.Scan(cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return keys
+		}
+		keys = append(keys, batch...)
+		if next == 0 {
+			return keys
+		}
+		cursor = next
+	}
+}
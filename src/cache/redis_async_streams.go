@@ -58,29 +58,35 @@ func (r *streamingRedisStore) checkIfExists(key string) types.ResultCode {
 	}
 }
 
-func (r *streamingRedisStore) setTtlIfRequired(key string) int {
+// setTtlIfRequired - creates the key with the given value and a TTL if it doesn't exist yet.
+// Returns true if the key was created by this call.
+func (r *streamingRedisStore) setTtlIfRequired(key string, value int) bool {
 	_, ok := r.checkMap.Get(key)
 	if ok != types.HIT {
 		// its a miss. we need to check Redis
 		resultCode := r.checkIfExists(key)
 		if resultCode != types.HIT {
-			// doesn't exist in redis
-			r.client.SetXX(key, 1, getMaxAllowedTime())
+			// doesn't exist in redis. another node may still beat us to it
+			created, err := r.client.SetNX(key, value, getMaxAllowedTime()).Result()
 			r.checkMap.Put(key, "0", getMaxAllowedTime())
-			return 1
+			return err == nil && created
 		}
-		return 0
+		return false
 	}
-	return 0
+	return false
 }
 
 func (r *streamingRedisStore) IncrAndGet(key string) int {
-	result := r.setTtlIfRequired(key)
-	if result == 1 {
+	return r.IncrByAndGet(key, 1)
+}
+
+// IncrByAndGet - increments the counter by the given value and returns the new count
+func (r *streamingRedisStore) IncrByAndGet(key string, value int) int {
+	if r.setTtlIfRequired(key, value) {
 		// new entrant
-		return result
+		return value
 	}
-	val, err := r.client.Incr(key).Result()
+	val, err := r.client.IncrBy(key, int64(value)).Result()
 	if err != nil {
 		// something went wrong
 		// we will swallow the error and respond with 0
@@ -89,3 +95,34 @@ func (r *streamingRedisStore) IncrAndGet(key string) int {
 		return int(val)
 	}
 }
+
+// DecrByAndGet - gives back the given value. A counter that would drop below zero (e.g. it has already
+// expired) is removed instead, so that redis doesn't keep a negative key around without a TTL.
+func (r *streamingRedisStore) DecrByAndGet(key string, value int) int {
+	val, err := r.client.DecrBy(key, int64(value)).Result()
+	if err != nil {
+		// swallow the error, same as IncrByAndGet
+		return 0
+	}
+	if val < 0 {
+		r.client.Del(key)
+		return 0
+	}
+	return int(val)
+}
+
+func (r *streamingRedisStore) Put(key string, value string, ttl time.Duration) {
+	r.client.Set(key, value, ttl)
+}
+
+func (r *streamingRedisStore) Get(key string) (string, bool) {
+	return getValue(r.client, key)
+}
+
+func (r *streamingRedisStore) Delete(key string) {
+	r.client.Del(key)
+}
+
+func (r *streamingRedisStore) Keys(prefix string) []string {
+	return scanKeys(r.client, prefix)
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisTransport - the nodes share a redis stream. It keeps the messages of StreamRetention for replays
+type redisTransport struct {
+	client *redis.Client
+	config *SyncMemoryConfig
+	// set once redis has rejected trimming by id, which needs redis 6.2
+	trimByLength int32
+	// owned by the reader
+	joinedAt   string // the entry this node joined at
+	lastReadID string
+}
+
+func newRedisTransport(client *redis.Client, config *SyncMemoryConfig) *redisTransport {
+	return &redisTransport{client: client, config: config}
+}
+
+// Connect - joins the stream, finding where to start reading it from
+func (t *redisTransport) Connect(replay time.Duration) error {
+	ping := map[string]interface{}{"ping": "pong"}
+	args := redis.XAddArgs{Values: ping, Stream: t.config.stream}
+	res, err := t.client.XAdd(&args).Result()
+	if err != nil {
+		return err
+	}
+	t.joinedAt = res
+	t.lastReadID = res
+	if replay > 0 {
+		t.lastReadID = streamIDAt(time.Now().Add(-replay))
+	}
+	return nil
+}
+
+// Publish - adds the messages, and trims the stream. Only the messages decide whether it failed: they are in
+// the stream whatever became of the trim
+func (t *redisTransport) Publish(payloads [][]byte) error {
+	pipe := t.client.Pipeline()
+	adds := make([]*redis.StringCmd, 0, len(payloads))
+	for _, payload := range payloads {
+		adds = append(adds, pipe.XAdd(t.xaddArgs(map[string]interface{}{messageField: string(payload)})))
+	}
+	trim, byID := t.trim(pipe)
+	length := pipe.XLen(t.config.stream)
+	// the errors are those of the commands, checked one by one
+	pipe.Exec()
+	for _, add := range adds {
+		if err := add.Err(); err != nil {
+			return err
+		}
+	}
+	if trim != nil && trim.Err() != nil {
+		t.trimFailed(trim.Err(), byID)
+	}
+	if length.Err() == nil {
+		t.config.Metrics.SetStreamLength(t.config.stream, length.Val())
+	}
+	return nil
+}
+
+// trim - drops the entries older than StreamRetention, or past fallbackStreamMaxLen once redis has rejected
+// trimming by id. It reports whether it trims by id
+func (t *redisTransport) trim(pipe redis.Pipeliner) (*redis.Cmd, bool) {
+	minID, ok := t.retainedFrom()
+	if !ok {
+		return nil, false
+	}
+	if atomic.LoadInt32(&t.trimByLength) == 0 {
+		return pipe.Do("XTRIM", t.config.stream, "MINID", "~", minID), true
+	}
+	if t.config.StreamMaxLen > 0 {
+		// every XADD caps the stream already
+		return nil, false
+	}
+	return pipe.Do("XTRIM", t.config.stream, "MAXLEN", "~", fallbackStreamMaxLen), false
+}
+
+// trimFailed - a redis older than 6.2 rejects trimming by id. The stream is capped by length from then on
+func (t *redisTransport) trimFailed(err error, byID bool) {
+	if !byID {
+		t.config.Logger.Warn("unable to trim the sync stream", "stream", t.config.stream, "error", err)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&t.trimByLength, 0, 1) {
+		t.config.Logger.Warn("redis rejects trimming the sync stream by age, which needs redis 6.2. capping it by length instead",
+			"stream", t.config.stream, "max_len", t.maxLen(), "error", err)
+	}
+}
+
+// maxLen - the length the stream is capped at when it cannot be trimmed by age
+func (t *redisTransport) maxLen() int64 {
+	if t.config.StreamMaxLen > 0 {
+		return t.config.StreamMaxLen
+	}
+	return fallbackStreamMaxLen
+}
+
+// Receive - reads the next batch of entries. Batches of pings only are skipped over
+func (t *redisTransport) Receive(timeout time.Duration) ([]Received, error) {
+	for {
+		args := redis.XReadArgs{Count: t.config.ReadBatchSize, Block: timeout, Streams: []string{t.config.stream, t.lastReadID}}
+		res, err := t.client.XRead(&args).Result()
+		if err == redis.Nil {
+			// nothing new within the timeout
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// sample result
+		// [{go-throttler [{1553681118002-0 map[m:<msgpack encoded syncMessage>]}]}]
+		// we expect only one entry as we are explicitly sending the stream name
+		var streamEntries []redis.XMessage = res[0].Messages
+		received := make([]Received, 0, len(streamEntries))
+		for _, entry := range streamEntries {
+			t.lastReadID = entry.ID
+			payload, ok := entry.Values[messageField].(string)
+			if !ok {
+				// e.g. the ping written to join the stream
+				continue
+			}
+			received = append(received, Received{
+				Payload:  []byte(payload),
+				SentAt:   streamIDTime(entry.ID),
+				Replayed: streamIDBefore(entry.ID, t.joinedAt),
+			})
+		}
+		if len(received) > 0 || int64(len(streamEntries)) < t.config.ReadBatchSize {
+			return received, nil
+		}
+	}
+}
+
+// Close - the client is left open, being shared with the values of SyncedMemory
+func (t *redisTransport) Close() error {
+	return nil
+}
+
+func (t *redisTransport) xaddArgs(values map[string]interface{}) *redis.XAddArgs {
+	return &redis.XAddArgs{Stream: t.config.stream, Values: values, MaxLenApprox: t.config.StreamMaxLen}
+}
+
+// retainedFrom - the oldest stream entry id to keep
+func (t *redisTransport) retainedFrom() (string, bool) {
+	if t.config.StreamRetention < 0 {
+		return "", false
+	}
+	return streamIDAt(time.Now().Add(-t.config.StreamRetention)), true
+}
+
+// streamIDAt - the id of the first stream entry at or after the given time. Entry ids start with the unix millis
+// of the redis server, so the time is a wall clock one, never that of config.Clock
+func streamIDAt(t time.Time) string {
+	return fmt.Sprintf("%d-0", t.UnixNano()/int64(time.Millisecond))
+}
+
+// streamIDTime - when the entry was added
+func streamIDTime(id string) time.Time {
+	var millis int64
+	fmt.Sscanf(id, "%d-", &millis)
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// streamIDBefore - whether entry a came before entry b
+func streamIDBefore(a string, b string) bool {
+	var aMillis, aSeq, bMillis, bSeq uint64
+	fmt.Sscanf(a, "%d-%d", &aMillis, &aSeq)
+	fmt.Sscanf(b, "%d-%d", &bMillis, &bSeq)
+	return aMillis < bMillis || (aMillis == bMillis && aSeq < bSeq)
+}
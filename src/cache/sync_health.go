@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"time"
+)
+
+// SyncState - how far SyncedMemory is from sharing its counts with its peers
+type SyncState int32
+
+const (
+	SYNC_CONNECTING    SyncState = iota // the transport has not connected yet. counts are local only
+	SYNC_BOOTSTRAPPING                  // replaying the stream. the counts of the peers are partial
+	SYNC_HEALTHY
+	SYNC_DEGRADED // the last read or flush failed. counts are local, plus the last known ones of the peers
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SYNC_CONNECTING:
+		return "connecting"
+	case SYNC_BOOTSTRAPPING:
+		return "bootstrapping"
+	case SYNC_HEALTHY:
+		return "healthy"
+	default:
+		return "degraded"
+	}
+}
+
+// SyncHealth - the sync state of a SyncedMemory, e.g. for a readiness probe
+type SyncHealth struct {
+	State     SyncState
+	LastError error     // of the last failed read or flush, cleared by the next successful one
+	LastSync  time.Time // of the last successful read or flush
+	Peers     int
+}
+
+// Health - reports whether the counts are being shared with the peers
+func (sm *SyncedMemory) Health() SyncHealth {
+	sm.healthLock.Lock()
+	defer sm.healthLock.Unlock()
+	return SyncHealth{State: sm.state, LastError: sm.lastError, LastSync: sm.lastSync, Peers: sm.countPeers()}
+}
+
+func (sm *SyncedMemory) syncState() SyncState {
+	sm.healthLock.Lock()
+	defer sm.healthLock.Unlock()
+	return sm.state
+}
+
+func (sm *SyncedMemory) setSyncState(state SyncState) {
+	sm.healthLock.Lock()
+	defer sm.healthLock.Unlock()
+	sm.state = state
+}
+
+// syncSucceeded - a read or flush went through. A degraded node is healthy again
+func (sm *SyncedMemory) syncSucceeded() {
+	sm.healthLock.Lock()
+	defer sm.healthLock.Unlock()
+	sm.lastSync = time.Now()
+	sm.lastError = nil
+	if sm.state == SYNC_DEGRADED {
+		sm.state = SYNC_HEALTHY
+		sm.config.Logger.Info("sync with the peers recovered", "stream", sm.config.stream)
+	}
+}
+
+// syncFailed - a read or flush failed. Only the first failure in a row is logged as an error
+func (sm *SyncedMemory) syncFailed(operation string, err error) {
+	sm.healthLock.Lock()
+	defer sm.healthLock.Unlock()
+	sm.lastError = err
+	if sm.state == SYNC_CONNECTING || sm.state == SYNC_DEGRADED {
+		sm.config.Logger.Debug("sync with the peers still failing", "operation", operation, "error", err)
+		return
+	}
+	sm.state = SYNC_DEGRADED
+	sm.config.Logger.Error("sync with the peers failed. rate limiting ability impaired", "operation", operation,
+		"stream", sm.config.stream, "error", err)
+}
+
+// backoff - the wait before the given attempt at the transport, doubling from FlushInterval up to MaxReconnectBackoff
+func (sm *SyncedMemory) backoff(attempt int) time.Duration {
+	wait := sm.config.FlushInterval
+	for i := 1; i < attempt && wait < sm.config.MaxReconnectBackoff; i++ {
+		wait *= 2
+	}
+	if wait > sm.config.MaxReconnectBackoff {
+		return sm.config.MaxReconnectBackoff
+	}
+	return wait
+}
+
+// reconnect - connects the transport once it can be reached, then consumes it
+func (sm *SyncedMemory) reconnect() {
+	for attempt := 1; ; attempt++ {
+		time.Sleep(sm.backoff(attempt))
+		if sm.closed() {
+			return
+		}
+		err := sm.connect()
+		if err == nil {
+			sm.config.Logger.Info("connected to the peers", "stream", sm.config.stream, "attempts", attempt)
+			break
+		}
+		sm.syncFailed("connect", err)
+	}
+	sm.consumeStream()
+}
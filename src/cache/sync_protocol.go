@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// messageKind - what a sync message carries
+type messageKind uint8
+
+const (
+	msgDelta           messageKind = iota + 1 // the counts that changed since the previous flush
+	msgSnapshot                               // every count of the host, sent on request
+	msgSnapshotRequest                        // asks the target host for a snapshot
+	msgHeartbeat                              // sent instead of an empty delta, to keep the host alive for its peers
+)
+
+// messageField - the only field of a redis stream entry, holding the msgpack encoded syncMessage
+const messageField = "m"
+
+// syncMessage - one message between the nodes. Counts are the node's own entries in the counters of the
+// keys, which only go up, so applying a message twice or out of order is harmless. Seq goes up by one with
+// every delta or snapshot a node sends, and heartbeats carry the last one; a receiver that sees it skip asks
+// for a snapshot. Incarnation goes up with every restart of the node, which starts over from Seq 1
+type syncMessage struct {
+	Kind        messageKind             `msgpack:"k"`
+	Node        string                  `msgpack:"n"`
+	Incarnation uint64                  `msgpack:"i"`
+	Seq         uint64                  `msgpack:"s,omitempty"`
+	Counts      map[string]counterEntry `msgpack:"c,omitempty"`
+	Target      string                  `msgpack:"t,omitempty"`
+}
+
+// counterEntry - a node's entry in the PN counter of a key: all it has added, and all it has given back
+type counterEntry struct {
+	Incr int `msgpack:"p"`
+	Decr int `msgpack:"n,omitempty"`
+}
+
+func encodeMessage(msg syncMessage) ([]byte, error) {
+	return msgpack.Marshal(&msg)
+}
+
+func decodeMessage(payload []byte) (syncMessage, bool) {
+	var msg syncMessage
+	if err := msgpack.Unmarshal(payload, &msg); err != nil {
+		return msg, false
+	}
+	return msg, msg.Node != ""
+}
@@ -1,37 +1,127 @@
 package cache
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"../clock"
+	"../logging"
+	"../metrics"
 	"../types"
 	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 )
 
 type SyncMemoryConfig struct {
 	MaxTTL        time.Duration
 	FlushInterval time.Duration
-	host          string
+	Clock         clock.Clock       // optional, defaults to the system clock
+	Metrics       metrics.Collector // optional
+	Logger        *slog.Logger      // optional, defaults to slog.Default(). per-event logs are at debug level
+	// StreamRetention - stream entries older than this are trimmed on every flush. Defaults to MaxTTL,
+	// past which the counts they carry have expired anyway. Negative disables it. Trimming by age needs Redis 6.2,
+	// older ones cap the stream at StreamMaxLen instead, or at 100000 entries when it is not set
+	StreamRetention time.Duration
+	// StreamMaxLen - optional cap on the number of stream entries, on top of StreamRetention
+	StreamMaxLen int64
+	// Namespace - keeps fleets sharing a Redis apart. The stream is "<Namespace>:<StreamName>"
+	Namespace string
+	// StreamName - defaults to go-throttler
+	StreamName string
+	// ReadBatchSize - stream entries fetched per read. Defaults to 1000
+	ReadBatchSize int64
+	// ReadTimeout - how long a read waits for new entries once the reader has caught up. Defaults to FlushInterval
+	ReadTimeout time.Duration
+	// MaxLag - the reader is falling behind when the entries it reads are older than this. Defaults to 2 FlushIntervals
+	MaxLag time.Duration
+	// PeerTimeout - a host that has sent nothing for this long has left, and its counts stop adding up.
+	// Hosts send a heartbeat every FlushInterval when they have no counts to send. Defaults to 3 FlushIntervals
+	PeerTimeout time.Duration
+	// NodeID - identifies this node to its peers, and must be unique among them. Defaults to the HOST
+	// environment variable, then to a random UUID
+	NodeID string
+	// BootstrapTimeout - how long NewSyncedMemory waits while it replays the last MaxTTL of the stream, so that
+	// it serves with the counts of its peers. The replay carries on in the background past it. Defaults to
+	// 5 seconds. Negative skips the replay, and the node starts from the counts flushed after it joined
+	BootstrapTimeout time.Duration
+	// MaxReconnectBackoff - the longest wait between attempts at the transport while it cannot be reached.
+	// The wait starts at FlushInterval and doubles with every failed attempt. Defaults to 30 seconds
+	MaxReconnectBackoff time.Duration
+	// Transport - optional, carries the counts between the nodes. Defaults to the redis stream. Without a
+	// redis config, plain values are kept by each node on its own
+	Transport Transport
+	stream    string
+}
+
+// Peer - another node syncing its counts through the same transport
+type Peer struct {
+	NodeID      string
+	Incarnation uint64    // changes when the node restarts
+	FirstSeen   time.Time // by the local clock, as are all the times of the peer
+	LastSeen    time.Time // when its last message was received
 }
 
 const (
-	streamName string = "go-throttler"
+	defaultStreamName string = "go-throttler"
+	// the cap of the stream when redis cannot trim it by age, and StreamMaxLen is not set
+	fallbackStreamMaxLen int64 = 100000
+	flushChunkSize       int   = 1000
+	flushChunkBytes      int   = 32 * 1024 // keeps a message within a UDP datagram
+	// plain values without an expiry, when there is no redis to keep them
+	noExpiry time.Duration = 100 * 365 * 24 * time.Hour
 )
 
 type SyncedMemory struct {
-	localMap          *types.RevolvingMap
-	globalHostDataMap *types.RevolvingMap // [data_point] => [host] => value
-	redisClient       *redis.Client
-	config            *SyncMemoryConfig
+	// [data_point] => *types.PNCounter with an entry per node, this one included. the data points
+	// carry their time window, so each window has its own counter
+	counters     *types.RevolvingMap
+	countersLock sync.Mutex
+	redisClient  *redis.Client // nil when the values are local
+	transport    Transport
+	config       *SyncMemoryConfig
+	// plain values live in redis itself, and are cached locally for a flush interval
+	values     *types.Map
+	valuesLock sync.Mutex
+	// the membership table: other hosts recently heard from
+	peers     map[string]*Peer
+	peerSeqs  map[string]uint64 // the last sequence number seen from each host
+	peersLock sync.Mutex
+	// keys changed since the last flush
+	dirty     map[string]struct{}
+	dirtyLock sync.Mutex
+	// flushes are serialized, so that sequence numbers reach the stream in order
+	flushLock         sync.Mutex
+	seq               uint64
+	snapshotRequested int32 // accessed atomically
+	// tells this run of the node apart from its earlier ones
+	incarnation uint64
+	// the incarnation of the last node seen claiming our node id, accessed atomically
+	impostor uint64
+	// messages sent before this node joined are replayed while bootstrapping
+	bootstrapping bool // owned by the reader
+	bootstrapped  chan struct{}
+	// what Health reports
+	state      SyncState
+	lastError  error
+	lastSync   time.Time
+	healthLock sync.Mutex
+	// closed by Close
+	done      chan struct{}
+	closeOnce sync.Once
 	// internal
-	lastReadStreamID string
+	lastSentAt time.Time // of the last message read
 }
 
-// GetLocalIP returns the non loopback local IP of the host
+// GetLocalIP returns the non loopback local IP of the host.
+// Deprecated: SyncedMemory identifies itself by SyncMemoryConfig.NodeID instead
 func GetLocalIP() string {
 	hostconf := os.Getenv("HOST")
 	if len(hostconf) > 0 {
@@ -52,187 +142,653 @@ func GetLocalIP() string {
 	return ""
 }
 
-// NewSyncedMemory - constructs a new instance of SyncedMemory
+// NewSyncedMemory - constructs a new instance of SyncedMemory. When the transport cannot be reached, it starts
+// with local counts only and keeps trying in the background. Health tells how the sync is going.
+// redisConfig may be nil when SyncMemoryConfig.Transport is set
 func NewSyncedMemory(syncConfig *SyncMemoryConfig, redisConfig *RedisConfig) *SyncedMemory {
-	localMap := types.NewRevolvingMap(syncConfig.MaxTTL)
-	client := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", redisConfig.Host, redisConfig.Port),
-		Password: redisConfig.Password,
-		DB:       redisConfig.DB,
-	})
-	globalDataMap := types.NewRevolvingMap(syncConfig.MaxTTL)
-	syncConfig.host = GetLocalIP()
-
-	sm := &SyncedMemory{localMap: localMap, redisClient: client, config: syncConfig, globalHostDataMap: globalDataMap}
-	sm.initializeStreamPointer() // blocking operation
+	syncConfig.Clock = clock.OrSystem(syncConfig.Clock)
+	syncConfig.Metrics = metrics.OrNop(syncConfig.Metrics)
+	syncConfig.Logger = logging.OrDefault(syncConfig.Logger)
+	if syncConfig.StreamName == "" {
+		syncConfig.StreamName = defaultStreamName
+	}
+	syncConfig.stream = syncConfig.StreamName
+	if syncConfig.Namespace != "" {
+		syncConfig.stream = syncConfig.Namespace + ":" + syncConfig.StreamName
+	}
+	if syncConfig.StreamRetention == 0 {
+		syncConfig.StreamRetention = syncConfig.MaxTTL
+	}
+	if syncConfig.ReadBatchSize <= 0 {
+		syncConfig.ReadBatchSize = 1000
+	}
+	if syncConfig.ReadTimeout <= 0 {
+		syncConfig.ReadTimeout = syncConfig.FlushInterval
+	}
+	if syncConfig.MaxLag <= 0 {
+		syncConfig.MaxLag = 2 * syncConfig.FlushInterval
+	}
+	if syncConfig.PeerTimeout <= 0 {
+		syncConfig.PeerTimeout = 3 * syncConfig.FlushInterval
+	}
+	if syncConfig.BootstrapTimeout == 0 {
+		syncConfig.BootstrapTimeout = 5 * time.Second
+	}
+	if syncConfig.MaxReconnectBackoff <= 0 {
+		syncConfig.MaxReconnectBackoff = 30 * time.Second
+	}
+	var client *redis.Client
+	if redisConfig != nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", redisConfig.Host, redisConfig.Port),
+			Password: redisConfig.Password,
+			DB:       redisConfig.DB,
+		})
+	}
+	transport := syncConfig.Transport
+	if transport == nil {
+		transport = newRedisTransport(client, syncConfig)
+	}
+	counters := types.NewRevolvingMapWithConfig(syncConfig.MaxTTL, types.RevolvingMapConfig{Clock: syncConfig.Clock, Logger: syncConfig.Logger})
+	if syncConfig.NodeID == "" {
+		syncConfig.NodeID = os.Getenv("HOST")
+	}
+	if syncConfig.NodeID == "" {
+		syncConfig.NodeID = uuid.NewString()
+	}
+	syncConfig.Logger = syncConfig.Logger.With("node_id", syncConfig.NodeID)
+
+	sm := &SyncedMemory{counters: counters, redisClient: client, transport: transport, config: syncConfig}
+	// wall time goes up from one run to the next, whatever the configured clock
+	sm.incarnation = uint64(time.Now().UnixNano())
+	sm.values = types.NewMapWithClock(syncConfig.Clock)
+	sm.peers = make(map[string]*Peer)
+	sm.peerSeqs = make(map[string]uint64)
+	sm.dirty = make(map[string]struct{})
+	sm.bootstrapped = make(chan struct{})
+	sm.done = make(chan struct{})
 	go sm.scheduleFlush()
-	go sm.scheduleReadFromStream()
+	if err := sm.connect(); err != nil {
+		syncConfig.Logger.Warn("unable to connect to the peers. starting with local counts only", "stream", syncConfig.stream, "error", err)
+		sm.syncFailed("connect", err)
+		go sm.reconnect()
+		return sm
+	}
+	go sm.consumeStream()
+	if syncConfig.BootstrapTimeout > 0 {
+		select {
+		case <-sm.bootstrapped:
+		case <-time.After(syncConfig.BootstrapTimeout):
+			syncConfig.Logger.Warn("serving before the replay of the sync messages has caught up. global counts are low for now",
+				"stream", syncConfig.stream, "timeout", syncConfig.BootstrapTimeout)
+		}
+	}
 	return sm
 }
 
 // IncrAndGet - increment the value pertaining to the given key
 func (sm *SyncedMemory) IncrAndGet(key string) int {
-	val, ok := sm.localMap.GetInt(key)
-	gval := sm.GetGlobalCount(key)
-	log.Println("Global value is: ", gval)
-	if ok {
-		sm.localMap.PutInt(key, val+1)
-		return val + gval + 1
+	return sm.IncrByAndGet(key, 1)
+}
+
+// IncrByAndGet - increment the value pertaining to the given key by the given amount
+func (sm *SyncedMemory) IncrByAndGet(key string, value int) int {
+	sm.countersLock.Lock()
+	counter := sm.counter(key)
+	counter.Incr(sm.config.NodeID, value)
+	total := counter.Value()
+	local := counter.NodeValue(sm.config.NodeID)
+	sm.countersLock.Unlock()
+	if sm.config.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		sm.config.Logger.Debug("incremented synced counter", "key", key, "local", local, "global", total-local, "by", value)
 	}
-	sm.localMap.PutInt(key, 1)
-	return gval + 1
+	sm.markDirty(key)
+	return total
 }
 
+// DecrByAndGet - gives back part of this host's contribution to the given key
+func (sm *SyncedMemory) DecrByAndGet(key string, value int) int {
+	sm.countersLock.Lock()
+	defer sm.countersLock.Unlock()
+	m, ok := sm.counters.Get(key)
+	if !ok {
+		// nothing recorded any more, there is nothing to give back
+		return 0
+	}
+	counter := m.(*types.PNCounter)
+	if local := counter.NodeValue(sm.config.NodeID); local < value {
+		value = local
+	}
+	if value > 0 {
+		counter.Decr(sm.config.NodeID, value)
+		sm.markDirty(key)
+	}
+	return counter.Value()
+}
+
+// GetGlobalCount - the count of the other hosts for the given key
 func (sm *SyncedMemory) GetGlobalCount(key string) int {
-	hostLevelCount, ok := sm.globalHostDataMap.Get(key)
-	if ok {
-		var result int = 0
-		hostMap := hostLevelCount.(*types.RevolvingMap)
-		keys := hostMap.Keys()
-		for _, key := range keys {
-			if key == nil {
-				continue
-			}
-			res, ok := hostMap.Get(key.(string))
-			if ok {
-				result += res.(int)
-			}
-		}
-		return result
+	sm.countersLock.Lock()
+	defer sm.countersLock.Unlock()
+	m, ok := sm.counters.Get(key)
+	if !ok {
+		return 0
 	}
-	return 0
+	counter := m.(*types.PNCounter)
+	return counter.Value() - counter.NodeValue(sm.config.NodeID)
 }
 
-type flatEntry struct {
-	key string
-	val int
+// counter - the counter of the key, created on first use. The caller holds countersLock
+func (sm *SyncedMemory) counter(key string) *types.PNCounter {
+	if m, ok := sm.counters.Get(key); ok {
+		return m.(*types.PNCounter)
+	}
+	counter := types.NewPNCounter()
+	sm.counters.Put(key, counter)
+	return counter
 }
 
+// scheduleFlush - the only flusher. It flushes every FlushInterval, on the second, until Close. The clock is
+// waited on rather than ticked, so that a fake clock drives the flushes
 func (sm *SyncedMemory) scheduleFlush() {
-	nextTime := time.Now().Truncate(time.Second)
-	nextTime = nextTime.Add(sm.config.FlushInterval)
-	time.Sleep(time.Until(nextTime))
-	go sm.flush()
-	go sm.scheduleFlush()
+	for {
+		now := sm.config.Clock.Now()
+		nextTime := now.Truncate(time.Second).Add(sm.config.FlushInterval)
+		if !nextTime.After(now) {
+			// intervals under a second
+			nextTime = now.Add(sm.config.FlushInterval)
+		}
+		select {
+		case <-sm.config.Clock.After(nextTime.Sub(now)):
+			sm.flush()
+		case <-sm.done:
+			return
+		}
+	}
+}
+
+// Close - stops syncing, and closes the transport. The counts stay readable, local ones only
+func (sm *SyncedMemory) Close() error {
+	sm.closeOnce.Do(func() { close(sm.done) })
+	sm.flushLock.Lock()
+	defer sm.flushLock.Unlock()
+	return sm.transport.Close()
 }
 
-// this is a blocking call
-// consider using channel for implementing this in a non-blocking way
-func (sm *SyncedMemory) initializeStreamPointer() {
-	ping := map[string]interface{}{"ping": "pong"}
-	args := redis.XAddArgs{Values: ping, Stream: streamName}
-	res, err := sm.redisClient.XAdd(&args).Result()
+func (sm *SyncedMemory) closed() bool {
+	select {
+	case <-sm.done:
+		return true
+	default:
+		return false
+	}
+}
 
-	if err != nil {
-		log.Fatalf("Unable to obtain stream pointer. Unrecoverable error")
+// connect - connects the transport, replaying the messages of the last MaxTTL where it keeps them
+func (sm *SyncedMemory) connect() error {
+	replay := time.Duration(0)
+	if sm.config.BootstrapTimeout > 0 {
+		// counts older than MaxTTL have expired anyway
+		replay = sm.config.MaxTTL
+	}
+	if err := sm.transport.Connect(replay); err != nil {
+		return err
 	}
-	sm.lastReadStreamID = res
+	sm.syncSucceeded()
+	if replay > 0 {
+		sm.bootstrapping = true
+		sm.setSyncState(SYNC_BOOTSTRAPPING)
+	} else {
+		sm.setSyncState(SYNC_HEALTHY)
+	}
+	return nil
 }
 
-func (sm *SyncedMemory) scheduleReadFromStream() {
-	nextTime := time.Now().Truncate(time.Second)
-	nextTime = nextTime.Add(sm.config.FlushInterval)
-	time.Sleep(time.Until(nextTime))
-	go sm.readFromStream()
-	go sm.scheduleReadFromStream()
+// consumeStream - the only reader of the transport. It reads back to back while there is a backlog,
+// and otherwise waits on a blocking read for the next flush of the other hosts
+func (sm *SyncedMemory) consumeStream() {
+	behind := false
+	failures := 0
+	for !sm.closed() {
+		block := sm.config.ReadTimeout
+		if sm.bootstrapping {
+			// the replay is over as soon as a read brings no replayed messages
+			block = -1
+		}
+		entries, replaying, err := sm.readFromStream(block)
+		if err != nil {
+			// let the transport recover before trying again
+			failures++
+			time.Sleep(sm.backoff(failures))
+			continue
+		}
+		failures = 0
+		if !sm.bootstrapping {
+			// replayed messages are as old as they were sent. a host whose later messages are in the next
+			// batches would be taken for gone
+			sm.expirePeers()
+		}
+		if sm.bootstrapping && !replaying {
+			sm.bootstrapping = false
+			close(sm.bootstrapped)
+			if sm.syncState() == SYNC_BOOTSTRAPPING {
+				sm.setSyncState(SYNC_HEALTHY)
+			}
+			sm.config.Logger.Info("replayed the sync messages", "stream", sm.config.stream, "peers", sm.countPeers(),
+				"key_count", sm.counters.Len())
+		}
+		if entries == 0 {
+			continue
+		}
+		lag := time.Since(sm.lastSentAt)
+		if lag > sm.config.MaxLag && !behind {
+			sm.config.Logger.Warn("sync reader is falling behind. global counts are stale",
+				"stream", sm.config.stream, "sent_at", sm.lastSentAt, "lag", lag, "entries", entries)
+		} else if lag <= sm.config.MaxLag && behind {
+			sm.config.Logger.Info("sync reader has caught up", "stream", sm.config.stream, "lag", lag)
+		}
+		behind = lag > sm.config.MaxLag
+	}
 }
 
-func (sm *SyncedMemory) readFromStream() {
-	log.Println("Beginning read from Redis stream")
-	args := redis.XReadArgs{Count: 100, Streams: []string{streamName, sm.lastReadStreamID}}
-	res, err := sm.redisClient.XRead(&args).Result()
+// readFromStream - reads the next batch of messages, waiting for up to block when there are none.
+// A negative block returns straight away. It reports whether the last of them was replayed
+func (sm *SyncedMemory) readFromStream(block time.Duration) (int, bool, error) {
+	start := time.Now()
+	received, err := sm.transport.Receive(block)
+	if err != nil && sm.closed() {
+		return 0, false, err
+	}
 	if err != nil {
-		log.Println("Error while trying to read from stream. Rate limiting ability impaired.")
-		return
+		sm.syncFailed("read", err)
+		sm.config.Metrics.ObserveStreamRead(time.Since(start), 0, false)
+		return 0, false, err
 	}
-	// sample result
-	// [{go-throttler [{1553681118002-0 map[host:172.16.44.151 2019/03/03_15:35:10_dp1_api/call1_cl1:40]}]}]
-	// we expect only one entry as we are explicitly sending the stream name
-	var streamMap redis.XStream = res[0]
-	var streamEntries []redis.XMessage = streamMap.Messages
-	var lastKnownID string
-	var currentHost string = sm.config.host
-	log.Println("Current host: ", currentHost)
-	for _, entry := range streamEntries {
-		// XMessage {ID string, Values map[string]interface{}}
-		lastKnownID = entry.ID
-		values := entry.Values
-		host, hasHost := values["host"]
-		if hasHost == false {
-			// skip this
+	sm.syncSucceeded()
+	if len(received) == 0 {
+		// nothing new within the timeout
+		sm.config.Metrics.ObserveStreamRead(time.Since(start), 0, true)
+		return 0, false, nil
+	}
+	var currentNode string = sm.config.NodeID
+	for _, entry := range received {
+		sm.lastSentAt = entry.SentAt
+		msg, ok := decodeMessage(entry.Payload)
+		if !ok {
+			continue
+		}
+		if msg.Node == currentNode {
+			// replayed ones are of an earlier run of ours
+			if msg.Incarnation != sm.incarnation && !entry.Replayed {
+				sm.rejectImpostor(msg)
+			}
 			continue
 		}
-		if host == currentHost {
+		// SentAt is by the clock of the sender, or of redis. ours is the only one the peer timeout can go by
+		accepted, restarted := sm.markPeerSeen(msg.Node, msg.Incarnation, sm.config.Clock.Now())
+		if !accepted {
+			// left over from an earlier run of the node
 			continue
 		}
-		log.Printf("Processing %+v\n", values)
-		for k, v := range values {
-			if k == "host" {
-				continue
-			}
-			_, ok := sm.globalHostDataMap.Get(k)
-			if ok == false { // new datapoint that we are seeing for the first time
-				sm.globalHostDataMap.Put(k, types.NewRevolvingMap(sm.config.MaxTTL))
-			}
-			m, _ := sm.globalHostDataMap.Get(k)
-			rmap := m.(*types.RevolvingMap)
-			intVal, err := strconv.Atoi(v.(string))
-			if err != nil {
-				log.Printf("Cannot convert %s to int value. Impaired performance of the system.", v)
-			} else {
-				rmap.PutInt(host.(string), intVal)
+		if restarted {
+			sm.dropCounts(msg.Node)
+		}
+		if msg.Kind == msgSnapshotRequest {
+			if msg.Target == currentNode {
+				atomic.StoreInt32(&sm.snapshotRequested, 1)
 			}
+			continue
+		}
+		if !sm.inSequence(msg) {
+			sm.requestSnapshot(msg.Node)
+		}
+		if msg.Kind == msgHeartbeat {
+			continue
+		}
+		sm.config.Logger.Debug("processing sync message", "sent_at", entry.SentAt, "peer", msg.Node, "seq", msg.Seq, "key_count", len(msg.Counts))
+		// the entries only go up. merging keeps the highest, so late or repeated messages change nothing
+		sm.countersLock.Lock()
+		for k, entry := range msg.Counts {
+			sm.counter(k).MergeEntry(msg.Node, entry.Incr, entry.Decr)
+		}
+		sm.countersLock.Unlock()
+	}
+	sm.config.Metrics.ObserveStreamRead(time.Since(start), time.Since(sm.lastSentAt), true)
+	sm.config.Metrics.SetPeerHosts(sm.countPeers())
+	sm.config.Metrics.SetKeyCount("synced_memory_global", sm.counters.Len())
+	sm.config.Logger.Debug("completed read of sync messages", "stream", sm.config.stream, "sent_at", sm.lastSentAt,
+		"entries", len(received), "key_count", sm.counters.Len())
+	return len(received), received[len(received)-1].Replayed, nil
+}
+
+// markPeerSeen - adds the node to the membership table, or refreshes it. Messages of an earlier
+// incarnation than the one known are not accepted. A later one means the node restarted without our
+// noticing: the counts of its previous run are gone, and its sequence starts over
+func (sm *SyncedMemory) markPeerSeen(node string, incarnation uint64, seenAt time.Time) (accepted bool, restarted bool) {
+	sm.peersLock.Lock()
+	defer sm.peersLock.Unlock()
+	peer, ok := sm.peers[node]
+	if !ok {
+		peer = &Peer{NodeID: node, Incarnation: incarnation, FirstSeen: seenAt}
+		sm.peers[node] = peer
+		sm.config.Logger.Info("peer joined", "peer", node, "incarnation", incarnation)
+	}
+	if incarnation < peer.Incarnation {
+		return false, false
+	}
+	if incarnation > peer.Incarnation {
+		sm.config.Logger.Info("peer restarted", "peer", node, "incarnation", incarnation)
+		*peer = Peer{NodeID: node, Incarnation: incarnation, FirstSeen: seenAt}
+		delete(sm.peerSeqs, node)
+		restarted = true
+	}
+	if seenAt.After(peer.LastSeen) {
+		peer.LastSeen = seenAt
+	}
+	return true, restarted
+}
+
+// rejectImpostor - messages from another node with our node id would be taken for our own, and their
+// counts lost. They are dropped, and the misconfiguration logged once per offending incarnation
+func (sm *SyncedMemory) rejectImpostor(msg syncMessage) {
+	if atomic.SwapUint64(&sm.impostor, msg.Incarnation) != msg.Incarnation {
+		sm.config.Logger.Error("another node claims our node id. its counts are ignored, node ids must be unique",
+			"incarnation", sm.incarnation, "impostor_incarnation", msg.Incarnation)
+	}
+}
+
+func (sm *SyncedMemory) countPeers() int {
+	sm.peersLock.Lock()
+	defer sm.peersLock.Unlock()
+	return len(sm.peers)
+}
+
+// expirePeers - drops the hosts that have gone quiet for PeerTimeout, along with their counts
+func (sm *SyncedMemory) expirePeers() {
+	sm.peersLock.Lock()
+	now := sm.config.Clock.Now()
+	departed := []string{}
+	for host, peer := range sm.peers {
+		if now.Sub(peer.LastSeen) > sm.config.PeerTimeout {
+			departed = append(departed, host)
+			delete(sm.peers, host)
+			// should it come back, it is a new peer that owes us a snapshot
+			delete(sm.peerSeqs, host)
 		}
 	}
-	// log.Printf("%+v\n", sm.globalHostDataMap)
-	sm.lastReadStreamID = lastKnownID
-	log.Println("Completed read from Redis stream")
+	sm.peersLock.Unlock()
+	for _, node := range departed {
+		sm.config.Logger.Info("peer departed, dropping its counts", "peer", node, "timeout", sm.config.PeerTimeout)
+		sm.dropCounts(node)
+	}
+	if len(departed) > 0 {
+		sm.config.Metrics.SetPeerHosts(sm.countPeers())
+	}
+}
+
+// dropCounts - forgets every count reported by the node
+func (sm *SyncedMemory) dropCounts(node string) {
+	sm.countersLock.Lock()
+	defer sm.countersLock.Unlock()
+	for _, key := range sm.counters.Keys() {
+		if key == nil {
+			continue
+		}
+		if m, ok := sm.counters.Get(key.(string)); ok {
+			m.(*types.PNCounter).Delete(node)
+		}
+	}
+}
+
+// Peers - the other nodes currently syncing through the transport, by node id
+func (sm *SyncedMemory) Peers() []Peer {
+	sm.peersLock.Lock()
+	defer sm.peersLock.Unlock()
+	peers := make([]Peer, 0, len(sm.peers))
+	for _, peer := range sm.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeID < peers[j].NodeID })
+	return peers
 }
 
-// flush - pushes the local data into Redis Stream
+// flush - publishes the counts that changed since the previous flush, or all of them when a peer has asked for a snapshot
 func (sm *SyncedMemory) flush() {
-	log.Println("Beginning Flush")
-	// ip := GetLocalIP()
-	internalMap, lock := sm.localMap.GetCurrentMapWithLock()
-	pipe := sm.redisClient.Pipeline()
-	lock.RLock()
-	defer lock.RUnlock()
-	dataPoints := make([]flatEntry, len(*internalMap))
-	count := 0
-	for k, v := range *internalMap {
-		dataPoints[count] = flatEntry{key: k.(string), val: v.(int)}
-		count = count + 1
-	}
-	// TODO - now stream it to Redis
-	ip := sm.config.host
-	totalDataPoints := len(dataPoints)
-	chunkSize := 100
-	chunks := totalDataPoints / chunkSize
-	leftOver := totalDataPoints % chunkSize
-	for i := 0; i < chunks; i++ {
-		valueMap := make(map[string]interface{})
-		valueMap["host"] = ip
-		for j := 0; j < chunkSize; j++ {
-			cur := i*chunkSize + j
-			entry := dataPoints[cur]
-			valueMap[entry.key] = entry.val
-		}
-		xargs := &redis.XAddArgs{Values: valueMap}
-		pipe.XAdd(xargs)
-	}
-
-	valueMap := make(map[string]interface{})
-	valueMap["host"] = ip
-	for i := 0; i < leftOver; i++ {
-		entry := dataPoints[i]
-		valueMap[entry.key] = entry.val
-	}
-	xargs := &redis.XAddArgs{Values: valueMap, Stream: streamName}
-	pipe.XAdd(xargs)
-	_, err := pipe.Exec()
+	if sm.syncState() == SYNC_CONNECTING {
+		// the changed keys wait for the connection
+		return
+	}
+	sm.flushLock.Lock()
+	defer sm.flushLock.Unlock()
+	start := time.Now()
+	kind := msgDelta
+	keys := sm.takeDirtyKeys()
+	if atomic.CompareAndSwapInt32(&sm.snapshotRequested, 1, 0) {
+		kind = msgSnapshot
+		keys = sm.localKeys()
+	}
+	payloads := [][]byte{}
+	chunk := make(map[string]counterEntry)
+	chunkBytes := 0
+	for _, key := range keys {
+		if entry, ok := sm.ownEntry(key); ok {
+			chunk[key] = entry
+			chunkBytes += len(key) + 24
+		}
+		if len(chunk) == flushChunkSize || chunkBytes >= flushChunkBytes {
+			payloads = sm.publish(payloads, kind, chunk)
+			chunk = make(map[string]counterEntry)
+			chunkBytes = 0
+		}
+	}
+	if len(chunk) > 0 || (kind == msgSnapshot && len(payloads) == 0) {
+		// a snapshot goes out even with no counts, so that the peer that asked for it learns our sequence number
+		payloads = sm.publish(payloads, kind, chunk)
+	} else if len(payloads) == 0 {
+		payloads = sm.heartbeat(payloads)
+	}
+	err := sm.transport.Publish(payloads)
+	sm.config.Metrics.ObserveFlush(time.Since(start), err == nil)
+	sm.config.Metrics.SetKeyCount("synced_memory_local", len(sm.localKeys()))
 	if err != nil {
-		log.Println("Error while streaming data via Redis Pipe")
-	} else {
-		log.Println("Completed flushing")
+		// the keys go out with the next flush. the peers will see the skipped sequence numbers and ask for a snapshot
+		for _, key := range keys {
+			sm.markDirty(key)
+		}
+		sm.syncFailed("flush", err)
+		return
+	}
+	sm.syncSucceeded()
+	sm.config.Logger.Debug("completed flush", "stream", sm.config.stream, "key_count", len(keys), "snapshot", kind == msgSnapshot, "seq", sm.seq)
+}
+
+// publish - adds a message with the next sequence number
+func (sm *SyncedMemory) publish(payloads [][]byte, kind messageKind, counts map[string]counterEntry) [][]byte {
+	sm.seq++
+	payload, err := encodeMessage(syncMessage{Kind: kind, Node: sm.config.NodeID, Incarnation: sm.incarnation, Seq: sm.seq, Counts: counts})
+	if err != nil {
+		sm.config.Logger.Error("unable to encode sync message", "seq", sm.seq, "error", err)
+		return payloads
+	}
+	return append(payloads, payload)
+}
+
+// heartbeat - adds a message that tells the peers this host is alive, and the sequence number of its last message
+func (sm *SyncedMemory) heartbeat(payloads [][]byte) [][]byte {
+	payload, err := encodeMessage(syncMessage{Kind: msgHeartbeat, Node: sm.config.NodeID, Incarnation: sm.incarnation, Seq: sm.seq})
+	if err != nil {
+		sm.config.Logger.Error("unable to encode heartbeat", "error", err)
+		return payloads
+	}
+	return append(payloads, payload)
+}
+
+// requestSnapshot - asks the host to publish all its counts with its next flush
+func (sm *SyncedMemory) requestSnapshot(node string) {
+	payload, err := encodeMessage(syncMessage{Kind: msgSnapshotRequest, Node: sm.config.NodeID, Incarnation: sm.incarnation, Target: node})
+	if err == nil {
+		err = sm.transport.Publish([][]byte{payload})
+	}
+	if err != nil {
+		sm.config.Logger.Warn("unable to request a snapshot", "peer", node, "error", err)
+	}
+}
+
+// inSequence - records the sequence number of the host's message, reporting whether it follows on from the
+// previous one. Joining a host that is past its first message counts as a gap, unless the replay of the
+// messages is under way: it goes back as far as counts are kept. A snapshot fills any gap, and a heartbeat
+// only tells whether messages were missed. Messages may come in out of order, the counters merge them all the same
+func (sm *SyncedMemory) inSequence(msg syncMessage) bool {
+	sm.peersLock.Lock()
+	defer sm.peersLock.Unlock()
+	last, known := sm.peerSeqs[msg.Node]
+	if msg.Kind == msgHeartbeat {
+		if !known && (msg.Seq == 0 || sm.bootstrapping) {
+			return true
+		}
+		if !known || msg.Seq > last {
+			// asks again with every heartbeat until a message of the host gets through
+			sm.config.Logger.Info("missed messages, requesting a snapshot", "peer", msg.Node, "last_seen", last, "seq", msg.Seq)
+			return false
+		}
+		return true
+	}
+	if known && msg.Seq <= last {
+		// late or repeated. the counters have its counts already, or higher ones
+		return true
+	}
+	sm.peerSeqs[msg.Node] = msg.Seq
+	if msg.Kind == msgSnapshot {
+		return true
+	}
+	if !known {
+		return msg.Seq == 1 || sm.bootstrapping
+	}
+	if msg.Seq != last+1 {
+		sm.config.Logger.Info("sequence gap, requesting a snapshot", "peer", msg.Node, "expected", last+1, "seq", msg.Seq)
+		return false
+	}
+	return true
+}
+
+func (sm *SyncedMemory) markDirty(key string) {
+	sm.dirtyLock.Lock()
+	defer sm.dirtyLock.Unlock()
+	sm.dirty[key] = struct{}{}
+}
+
+func (sm *SyncedMemory) takeDirtyKeys() []string {
+	sm.dirtyLock.Lock()
+	defer sm.dirtyLock.Unlock()
+	keys := make([]string, 0, len(sm.dirty))
+	for key := range sm.dirty {
+		keys = append(keys, key)
+	}
+	sm.dirty = make(map[string]struct{})
+	return keys
+}
+
+// localKeys - every key this host has counted
+func (sm *SyncedMemory) localKeys() []string {
+	sm.countersLock.Lock()
+	defer sm.countersLock.Unlock()
+	keys := []string{}
+	for _, key := range sm.counters.Keys() {
+		if key == nil {
+			continue
+		}
+		if m, ok := sm.counters.Get(key.(string)); ok && m.(*types.PNCounter).Has(sm.config.NodeID) {
+			keys = append(keys, key.(string))
+		}
+	}
+	return keys
+}
+
+// ownEntry - this host's entry in the counter of the key
+func (sm *SyncedMemory) ownEntry(key string) (counterEntry, bool) {
+	sm.countersLock.Lock()
+	defer sm.countersLock.Unlock()
+	m, ok := sm.counters.Get(key)
+	if !ok || !m.(*types.PNCounter).Has(sm.config.NodeID) {
+		return counterEntry{}, false
+	}
+	incr, decr := m.(*types.PNCounter).Entry(sm.config.NodeID)
+	return counterEntry{Incr: incr, Decr: decr}, true
+}
+
+// Put - values are written straight to redis, so that every node sees them on its next lookup
+func (sm *SyncedMemory) Put(key string, value string, ttl time.Duration) {
+	if sm.redisClient == nil {
+		sm.putLocal(key, value, ttl)
+		return
+	}
+	sm.redisClient.Set(sm.redisKey(key), value, ttl)
+	sm.valuesLock.Lock()
+	defer sm.valuesLock.Unlock()
+	sm.values.Put(key, value, sm.cachedValueTTL(ttl))
+}
+
+// Get - serves from the local copy when it is fresh enough. misses are cached too, being the common case
+func (sm *SyncedMemory) Get(key string) (string, bool) {
+	sm.valuesLock.Lock()
+	cached, resCode := sm.values.Get(key)
+	sm.valuesLock.Unlock()
+	if resCode == types.HIT {
+		return cached, cached != ""
+	}
+	if sm.redisClient == nil {
+		return "", false
+	}
+	val, ok := getValue(sm.redisClient, sm.redisKey(key))
+	sm.valuesLock.Lock()
+	defer sm.valuesLock.Unlock()
+	sm.values.Put(key, val, sm.config.FlushInterval)
+	return val, ok
+}
+
+func (sm *SyncedMemory) Delete(key string) {
+	if sm.redisClient != nil {
+		sm.redisClient.Del(sm.redisKey(key))
+	}
+	sm.valuesLock.Lock()
+	defer sm.valuesLock.Unlock()
+	sm.values.Delete(key)
+}
+
+func (sm *SyncedMemory) Keys(prefix string) []string {
+	if sm.redisClient == nil {
+		sm.valuesLock.Lock()
+		defer sm.valuesLock.Unlock()
+		return sm.values.Keys(prefix)
+	}
+	keys := scanKeys(sm.redisClient, sm.redisKey(prefix))
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, sm.redisKey(""))
+	}
+	return keys
+}
+
+// redisKey - the key of a value in redis, within the namespace if there is one
+func (sm *SyncedMemory) redisKey(key string) string {
+	if sm.config.Namespace == "" {
+		return key
+	}
+	return sm.config.Namespace + ":" + key
+}
+
+func (sm *SyncedMemory) cachedValueTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < sm.config.FlushInterval {
+		return ttl
+	}
+	return sm.config.FlushInterval
+}
+
+// putLocal - without redis, values are this node's own
+func (sm *SyncedMemory) putLocal(key string, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = noExpiry
 	}
+	sm.valuesLock.Lock()
+	defer sm.valuesLock.Unlock()
+	sm.values.Put(key, value, ttl)
 }
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"../tracing"
+)
+
+// ContextStore - a Store whose operations can be bound to a context, e.g. to nest their spans under the caller's
+type ContextStore interface {
+	Store
+	WithContext(ctx context.Context) Store
+}
+
+// tracedStore - starts a span around every operation of the store it wraps
+type tracedStore struct {
+	store  Store
+	name   string
+	tracer tracing.Tracer
+	ctx    context.Context
+}
+
+// NewTracedStore - wraps the store so that every operation gets a span, labelled with the given store name
+func NewTracedStore(store Store, name string, tracer tracing.Tracer) ContextStore {
+	return &tracedStore{store: store, name: name, tracer: tracer, ctx: context.Background()}
+}
+
+func (s *tracedStore) WithContext(ctx context.Context) Store {
+	bound := *s
+	bound.ctx = ctx
+	return &bound
+}
+
+func (s *tracedStore) start(operation string, key string) tracing.Span {
+	_, span := s.tracer.Start(s.ctx, "store."+operation)
+	span.SetAttribute("store", s.name)
+	span.SetAttribute("key", key)
+	return span
+}
+
+func (s *tracedStore) IncrAndGet(key string) int {
+	span := s.start("incr", key)
+	defer span.End()
+	val := s.store.IncrAndGet(key)
+	span.SetAttribute("value", val)
+	return val
+}
+
+func (s *tracedStore) IncrByAndGet(key string, value int) int {
+	span := s.start("incr", key)
+	defer span.End()
+	val := s.store.IncrByAndGet(key, value)
+	span.SetAttribute("value", val)
+	return val
+}
+
+func (s *tracedStore) DecrByAndGet(key string, value int) int {
+	span := s.start("decr", key)
+	defer span.End()
+	val := s.store.DecrByAndGet(key, value)
+	span.SetAttribute("value", val)
+	return val
+}
+
+func (s *tracedStore) Put(key string, value string, ttl time.Duration) {
+	span := s.start("put", key)
+	defer span.End()
+	s.store.Put(key, value, ttl)
+}
+
+func (s *tracedStore) Get(key string) (string, bool) {
+	span := s.start("get", key)
+	defer span.End()
+	val, ok := s.store.Get(key)
+	span.SetAttribute("hit", ok)
+	return val, ok
+}
+
+func (s *tracedStore) Delete(key string) {
+	span := s.start("delete", key)
+	defer span.End()
+	s.store.Delete(key)
+}
+
+func (s *tracedStore) Keys(prefix string) []string {
+	span := s.start("keys", prefix)
+	defer span.End()
+	return s.store.Keys(prefix)
+}
@@ -0,0 +1,24 @@
+package cache
+
+import "time"
+
+// Transport - carries the encoded sync messages between the nodes of a SyncedMemory. The redis stream
+// is the default one, NewGossipTransport does without redis
+type Transport interface {
+	// Connect - readies the transport. It is retried until it succeeds. Transports that keep the history
+	// of the messages receive the ones of the last replay first
+	Connect(replay time.Duration) error
+	// Publish - sends the messages to every node. A node may receive its own messages back
+	Publish(payloads [][]byte) error
+	// Receive - the messages that arrived since the last call, waiting up to timeout for some.
+	// A negative timeout does not wait
+	Receive(timeout time.Duration) ([]Received, error)
+	Close() error
+}
+
+// Received - a message, as it came off the transport
+type Received struct {
+	Payload  []byte
+	SentAt   time.Time // as far as the transport knows
+	Replayed bool      // sent before this node connected
+}
@@ -0,0 +1,96 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock - source of the current time for the limiter, the time slices and the stores.
+// Production code uses the system clock; tests and log replays can plug in a FakeClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+// NewSystemClock - returns a Clock backed by the time package
+func NewSystemClock() Clock {
+	return systemClock{}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// OrSystem - returns the given clock, falling back to the system clock when it is nil
+func OrSystem(c Clock) Clock {
+	if c == nil {
+		return NewSystemClock()
+	}
+	return c
+}
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// FakeClock - a Clock that only moves when told to. Safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// NewFakeClock - returns a FakeClock frozen at the given instant
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After - the returned channel fires once the fake time has been advanced past now+d
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	deadline := f.now.Add(d)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, waiter{deadline: deadline, ch: ch})
+	return ch
+}
+
+// Advance - moves the fake time forward and fires every timer that has become due
+func (f *FakeClock) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set - moves the fake time to the given instant and fires every timer that has become due
+func (f *FakeClock) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+	sort.Slice(f.waiters, func(i, j int) bool { return f.waiters[i].deadline.Before(f.waiters[j].deadline) })
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- t
+	}
+	f.waiters = pending
+}
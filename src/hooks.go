@@ -0,0 +1,111 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"sync"
+
+	"./notify"
+)
+
+// nearLimitHook - a hook for counters crossing percent of their quota
+type nearLimitHook struct {
+	percent int
+	hook    notify.Hook
+}
+
+type hooks struct {
+	onBreach       []notify.Hook
+	onShadowBreach []notify.Hook
+	onNearLimit    []nearLimitHook
+	onBanned       []notify.Hook
+	lock           sync.RWMutex
+}
+
+// OnBreach - the hook is called for every event rejected by an enforced rule. Shadow rules never call it
+func (r *ApiRateLimiter) OnBreach(hook notify.Hook) {
+	r.hooks.lock.Lock()
+	defer r.hooks.lock.Unlock()
+	r.hooks.onBreach = append(r.hooks.onBreach, hook)
+}
+
+// OnShadowBreach - the hook is called for every event over the quota of a shadow rule, which lets it through
+func (r *ApiRateLimiter) OnShadowBreach(hook notify.Hook) {
+	r.hooks.lock.Lock()
+	defer r.hooks.lock.Unlock()
+	r.hooks.onShadowBreach = append(r.hooks.onShadowBreach, hook)
+}
+
+// OnNearLimit - the hook is called by the event that takes a counter to percent of its quota,
+// which happens at most once per window for a fixed window rule
+func (r *ApiRateLimiter) OnNearLimit(percent int, hook notify.Hook) error {
+	if percent < 1 || percent > 100 {
+		return fmt.Errorf("near limit percentage must be within 1 and 100, got %d", percent)
+	}
+	r.hooks.lock.Lock()
+	defer r.hooks.lock.Unlock()
+	r.hooks.onNearLimit = append(r.hooks.onNearLimit, nearLimitHook{percent: percent, hook: hook})
+	return nil
+}
+
+// OnBanned - the hook is called whenever a client is put in the penalty box
+func (r *ApiRateLimiter) OnBanned(hook notify.Hook) {
+	r.hooks.lock.Lock()
+	defer r.hooks.lock.Unlock()
+	r.hooks.onBanned = append(r.hooks.onBanned, hook)
+}
+
+func (r *ApiRateLimiter) notification(kind notify.Kind, inst Event, l limit, count int) notify.Notification {
+	return notify.Notification{
+		Kind:       kind,
+		RuleId:     l.ruleId,
+		Scope:      l.scope.String(),
+		Subject:    inst.subject(l.scope),
+		ResourceId: inst.resourceId,
+		ClientId:   inst.clientId,
+		Count:      count,
+		Quota:      l.quota,
+		Time:       r.eventTime(inst),
+	}
+}
+
+// registered - a copy of the hooks, taken under the lock. The hooks are called without it, so that one may
+// register another, and a slow one holds up no registration
+func (r *ApiRateLimiter) registered(hooks *[]notify.Hook) []notify.Hook {
+	r.hooks.lock.RLock()
+	defer r.hooks.lock.RUnlock()
+	return append([]notify.Hook(nil), *hooks...)
+}
+
+// notifyNearLimit - calls the near limit hooks whose threshold this event's count has crossed
+func (r *ApiRateLimiter) notifyNearLimit(inst Event, l limit, count int) {
+	r.hooks.lock.RLock()
+	hooks := append([]nearLimitHook(nil), r.hooks.onNearLimit...)
+	r.hooks.lock.RUnlock()
+	previous := count - inst.weight()
+	for _, h := range hooks {
+		threshold := h.percent * l.quota
+		if previous*100 < threshold && count*100 >= threshold {
+			h.hook(r.notification(notify.NEAR_LIMIT, inst, l, count))
+		}
+	}
+}
+
+func (r *ApiRateLimiter) notifyBreach(inst Event, l limit, count int) {
+	for _, hook := range r.registered(&r.hooks.onBreach) {
+		hook(r.notification(notify.BREACH, inst, l, count))
+	}
+}
+
+func (r *ApiRateLimiter) notifyShadowBreach(inst Event, l limit, count int) {
+	for _, hook := range r.registered(&r.hooks.onShadowBreach) {
+		hook(r.notification(notify.SHADOW_BREACH, inst, l, count))
+	}
+}
+
+func (r *ApiRateLimiter) notifyBanned(inst Event, l limit, ban Ban) {
+	for _, hook := range r.registered(&r.hooks.onBanned) {
+		n := r.notification(notify.BANNED, inst, l, 0)
+		n.BannedUntil = ban.until
+		hook(n)
+	}
+}
@@ -0,0 +1,12 @@
+package logging
+
+import "log/slog"
+
+// OrDefault - the given logger, or slog's default when none was injected.
+// Per-event logs are emitted at debug level, which the default logger leaves off.
+func OrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import "time"
+
+// Decision - the outcome of an event against a rule
+type Decision string
+
+const (
+	ALLOWED          Decision = "allowed"
+	THROTTLED        Decision = "throttled"
+	SHADOW_THROTTLED Decision = "shadow_throttled" // a shadow rule would have rejected the event
+	ALLOWLISTED      Decision = "allowlisted"
+	DENYLISTED       Decision = "denylisted"
+	BANNED           Decision = "banned"
+)
+
+// Collector - receives the measurements of the limiter and its stores.
+// This package has no dependencies; plug in an implementation such as metrics/prom to export them.
+type Collector interface {
+	// limiter
+	ObserveDecision(ruleId string, decision Decision)
+	// stores
+	ObserveStoreOperation(store string, operation string, duration time.Duration)
+	// SyncedMemory
+	ObserveFlush(duration time.Duration, ok bool)
+	ObserveStreamRead(duration time.Duration, lag time.Duration, ok bool)
+	SetPeerHosts(count int)
+	SetKeyCount(mapName string, count int)
+	SetStreamLength(stream string, length int64)
+}
+
+// Nop - discards everything. Used when no collector is configured
+type Nop struct{}
+
+func (Nop) ObserveDecision(ruleId string, decision Decision)                             {}
+func (Nop) ObserveStoreOperation(store string, operation string, duration time.Duration) {}
+func (Nop) ObserveFlush(duration time.Duration, ok bool)                                 {}
+func (Nop) ObserveStreamRead(duration time.Duration, lag time.Duration, ok bool)         {}
+func (Nop) SetPeerHosts(count int)                                                       {}
+func (Nop) SetKeyCount(mapName string, count int)                                        {}
+func (Nop) SetStreamLength(stream string, length int64)                                  {}
+
+// OrNop - returns the given collector, falling back to Nop when it is nil
+func OrNop(c Collector) Collector {
+	if c == nil {
+		return Nop{}
+	}
+	return c
+}
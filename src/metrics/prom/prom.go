@@ -0,0 +1,130 @@
+package prom
+
+import (
+	"sync/atomic"
+	"time"
+
+	"../../metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector - exports the limiter's measurements to Prometheus. It is a prometheus.Collector itself:
+//
+//	collector := prom.NewCollector("go_throttler")
+//	prometheus.MustRegister(collector)
+//	limiter := NewApiRateLimiterWithConfig(cmrs, clrs, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Metrics: collector})
+type Collector struct {
+	decisions     *prometheus.CounterVec
+	storeLatency  *prometheus.HistogramVec
+	flushDuration prometheus.Histogram
+	readDuration  prometheus.Histogram
+	syncErrors    *prometheus.CounterVec
+	streamLag     prometheus.Gauge
+	peerHosts     prometheus.Gauge
+	keyCount      *prometheus.GaugeVec
+	streamLength  *prometheus.GaugeVec
+	lastSyncAge   prometheus.GaugeFunc
+	lastSync      int64 // unix nanos of the last successful flush or read, accessed atomically
+}
+
+// NewCollector - creates the metrics under the given namespace
+func NewCollector(namespace string) *Collector {
+	c := &Collector{
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "decisions_total", Help: "Events checked against each rule, by decision.",
+		}, []string{"rule", "decision"}),
+		storeLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "store_operation_seconds", Help: "Latency of the store operations.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"store", "operation"}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "sync_flush_seconds", Help: "Time taken to flush local counts to the stream.",
+		}),
+		readDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "sync_read_seconds", Help: "Time taken to read the counts of the other hosts from the stream.",
+		}),
+		syncErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "sync_errors_total", Help: "Failed flushes and reads.",
+		}, []string{"operation"}),
+		streamLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "sync_stream_lag_seconds", Help: "Age of the last stream entry read.",
+		}),
+		peerHosts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "sync_peer_hosts", Help: "Other hosts recently seen on the stream.",
+		}),
+		keyCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "memory_keys", Help: "Keys held in memory, by map.",
+		}, []string{"map"}),
+		streamLength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "sync_stream_length", Help: "Entries in the sync stream after its last trim.",
+		}, []string{"stream"}),
+	}
+	c.lastSyncAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "sync_last_success_age_seconds", Help: "Time since the last successful flush or read.",
+	}, func() float64 {
+		last := atomic.LoadInt64(&c.lastSync)
+		if last == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, last)).Seconds()
+	})
+	return c
+}
+
+func (c *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.decisions, c.storeLatency, c.flushDuration, c.readDuration,
+		c.syncErrors, c.streamLag, c.peerHosts, c.keyCount, c.streamLength, c.lastSyncAge}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *Collector) ObserveDecision(ruleId string, decision metrics.Decision) {
+	c.decisions.WithLabelValues(ruleId, string(decision)).Inc()
+}
+
+func (c *Collector) ObserveStoreOperation(store string, operation string, duration time.Duration) {
+	c.storeLatency.WithLabelValues(store, operation).Observe(duration.Seconds())
+}
+
+func (c *Collector) ObserveFlush(duration time.Duration, ok bool) {
+	c.flushDuration.Observe(duration.Seconds())
+	c.observeSync("flush", ok)
+}
+
+func (c *Collector) ObserveStreamRead(duration time.Duration, lag time.Duration, ok bool) {
+	c.readDuration.Observe(duration.Seconds())
+	if ok {
+		c.streamLag.Set(lag.Seconds())
+	}
+	c.observeSync("read", ok)
+}
+
+func (c *Collector) observeSync(operation string, ok bool) {
+	if ok {
+		atomic.StoreInt64(&c.lastSync, time.Now().UnixNano())
+	} else {
+		c.syncErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (c *Collector) SetPeerHosts(count int) {
+	c.peerHosts.Set(float64(count))
+}
+
+func (c *Collector) SetKeyCount(mapName string, count int) {
+	c.keyCount.WithLabelValues(mapName).Set(float64(count))
+}
+
+func (c *Collector) SetStreamLength(stream string, length int64) {
+	c.streamLength.WithLabelValues(stream).Set(float64(length))
+}
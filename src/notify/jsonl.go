@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONLSink - writes every notification as a line of JSON
+type JSONLSink struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{w: w}
+}
+
+// OpenJSONLFile - a JSONLSink appending to the given file, which is created if missing
+func OpenJSONLFile(path string) (*JSONLSink, *os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewJSONLSink(f), f, nil
+}
+
+func (s *JSONLSink) Send(n Notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
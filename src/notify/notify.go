@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../logging"
+)
+
+// Kind - what the client did to trigger a notification
+type Kind string
+
+const (
+	BREACH        Kind = "breach"
+	SHADOW_BREACH Kind = "shadow_breach"
+	NEAR_LIMIT    Kind = "near_limit"
+	BANNED        Kind = "banned"
+)
+
+// Notification - a client hitting, or getting close to, one of its limits
+type Notification struct {
+	Kind        Kind      `json:"kind"`
+	RuleId      string    `json:"rule_id,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	ResourceId  string    `json:"resource_id"`
+	ClientId    string    `json:"client_id"`
+	Count       int       `json:"count,omitempty"`
+	Quota       int       `json:"quota,omitempty"`
+	BannedUntil time.Time `json:"banned_until"`
+	Time        time.Time `json:"time"`
+}
+
+// Hook - called synchronously on the event's path. Anything slow belongs in an AsyncSink
+type Hook func(n Notification)
+
+// Sink - a destination for notifications
+type Sink interface {
+	Send(n Notification) error
+}
+
+// DropPolicy - what an AsyncSink does with a notification when its buffer is full
+type DropPolicy int
+
+const (
+	DROP_NEWEST DropPolicy = iota // default. the incoming notification is dropped
+	DROP_OLDEST                   // the oldest buffered notification makes room for the incoming one
+	BLOCK                         // the caller waits for room. this puts the sink on the event's path
+)
+
+// AsyncConfig - settings for NewAsyncSink
+type AsyncConfig struct {
+	BufferSize int          // defaults to 1024
+	DropPolicy DropPolicy   // defaults to DROP_NEWEST
+	Logger     *slog.Logger // optional. failed sends are logged here
+}
+
+// AsyncSink - buffers notifications and sends them to a Sink from a single goroutine
+type AsyncSink struct {
+	sink    Sink
+	policy  DropPolicy
+	logger  *slog.Logger
+	buffer  chan Notification
+	dropped int64 // accessed atomically
+	closed  bool
+	lock    sync.RWMutex
+	done    chan struct{}
+}
+
+// NewAsyncSink - starts sending to the given sink in the background. Call Close to flush and stop
+func NewAsyncSink(sink Sink, config AsyncConfig) *AsyncSink {
+	if config.BufferSize <= 0 {
+		config.BufferSize = 1024
+	}
+	a := &AsyncSink{
+		sink:   sink,
+		policy: config.DropPolicy,
+		logger: logging.OrDefault(config.Logger),
+		buffer: make(chan Notification, config.BufferSize),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Notify - queues the notification. Has the signature of a Hook, so that it can be registered as one
+func (a *AsyncSink) Notify(n Notification) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.closed {
+		atomic.AddInt64(&a.dropped, 1)
+		return
+	}
+	switch a.policy {
+	case BLOCK:
+		a.buffer <- n
+	case DROP_OLDEST:
+		for {
+			select {
+			case a.buffer <- n:
+				return
+			default:
+			}
+			select {
+			case <-a.buffer:
+				atomic.AddInt64(&a.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case a.buffer <- n:
+		default:
+			atomic.AddInt64(&a.dropped, 1)
+		}
+	}
+}
+
+// Dropped - the notifications that never made it to the sink's buffer
+func (a *AsyncSink) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// Close - stops accepting notifications and waits for the buffered ones to be sent
+func (a *AsyncSink) Close() {
+	a.lock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.buffer)
+	}
+	a.lock.Unlock()
+	<-a.done
+}
+
+func (a *AsyncSink) run() {
+	defer close(a.done)
+	for n := range a.buffer {
+		if err := a.sink.Send(n); err != nil {
+			a.logger.Warn("unable to send notification", "kind", n.Kind, "client_id", n.ClientId, "error", err)
+		}
+	}
+}
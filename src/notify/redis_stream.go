@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"encoding/json"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStreamSink - appends every notification to a Redis stream, as a JSON encoded "notification" field
+type RedisStreamSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreamSink - maxLen approximately caps the stream's length. 0 leaves it untrimmed
+func NewRedisStreamSink(client *redis.Client, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{client: client, stream: stream, maxLen: maxLen}
+}
+
+func (s *RedisStreamSink) Send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	args := redis.XAddArgs{
+		Stream:       s.stream,
+		MaxLenApprox: s.maxLen,
+		Values:       map[string]interface{}{"kind": string(n.Kind), "notification": string(body)},
+	}
+	return s.client.XAdd(&args).Err()
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookSink - POSTs every notification as JSON to a URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// DefaultWebhookTimeout - of the default client. A hung endpoint would otherwise hold up the AsyncSink
+// in front of it, and every notification after it would be dropped
+const DefaultWebhookTimeout = 5 * time.Second
+
+// NewWebhookSink - client is optional, defaulting to one that gives up after DefaultWebhookTimeout
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	return &WebhookSink{url: url, client: client}
+}
+
+func (s *WebhookSink) Send(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"./cache"
+	"./timeslice"
+)
+
+// PenaltyConfig - puts repeat offenders in a penalty box. A client that breaches its limits Breaches times
+// within Within is rejected outright for BanDuration, which doubles with every further ban.
+// The breaches are counted over a sliding window, estimated from the current and the previous one as
+// for ALGO_SLIDING_WINDOW rules. Bans live in the limiter's store, so every node sharing the store honours them.
+type PenaltyConfig struct {
+	Breaches       int
+	Within         time.Duration // up to 5 minutes, the lifetime of the counters in the stores
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration // optional cap on the escalation. without it, bans stop growing at 10 years
+	ResetAfter     time.Duration // how long a ban counts towards escalating the next one. defaults to a day
+}
+
+const (
+	penaltyBoxRuleId    = "penalty_box" // reported in metrics for events rejected by a ban
+	penaltyBreachPrefix = "penalty_breaches_"
+	penaltyBanPrefix    = "penalty_ban_"
+	penaltyLevelPrefix  = "penalty_level_"
+	// the lifetime of the counters in the stores, past which breaches would be forgotten within Within
+	penaltyMaxWithin = 300 * time.Second
+	// where the escalation stops without a MaxBanDuration, well short of overflowing a time.Duration
+	penaltyMaxBanDuration = 10 * 365 * 24 * time.Hour
+)
+
+// Ban - a client in the penalty box
+type Ban struct {
+	clientId string
+	until    time.Time
+	level    int // 1 for the first ban, going up with every repeat
+}
+
+func (c *PenaltyConfig) validate() error {
+	if c.Breaches <= 0 || c.Within <= 0 || c.BanDuration <= 0 {
+		return fmt.Errorf("penalty box needs positive Breaches, Within and BanDuration, got %+v", *c)
+	}
+	if c.Within > penaltyMaxWithin {
+		return fmt.Errorf("penalty box Within must be at most %s, the lifetime of the counters, got %s", penaltyMaxWithin, c.Within)
+	}
+	return nil
+}
+
+func (c *PenaltyConfig) banDuration(level int) time.Duration {
+	max := c.MaxBanDuration
+	if max <= 0 {
+		max = penaltyMaxBanDuration
+	}
+	duration := c.BanDuration
+	for i := 1; i < level && duration < max; i++ {
+		duration *= 2
+	}
+	if duration > max {
+		return max
+	}
+	return duration
+}
+
+func (c *PenaltyConfig) resetAfter() time.Duration {
+	if c.ResetAfter > 0 {
+		return c.ResetAfter
+	}
+	return 24 * time.Hour
+}
+
+func encodeBan(ban Ban) string {
+	return fmt.Sprintf("%d_%d", ban.until.Unix(), ban.level)
+}
+
+func decodeBan(clientId string, value string) (Ban, bool) {
+	var until int64
+	var level int
+	if _, err := fmt.Sscanf(value, "%d_%d", &until, &level); err != nil {
+		return Ban{}, false
+	}
+	return Ban{clientId: clientId, until: time.Unix(until, 0), level: level}, true
+}
+
+// checkBan - looks up a ban on the client that is still in force at the time of the event
+func (r *ApiRateLimiter) checkBan(store cache.Store, inst Event) (Ban, bool) {
+	val, ok := store.Get(penaltyBanPrefix + inst.clientId)
+	if !ok {
+		return Ban{}, false
+	}
+	ban, ok := decodeBan(inst.clientId, val)
+	if !ok || !r.eventTime(inst).Before(ban.until) {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// recordBreach - counts the breach towards the penalty box, and bans the client once it has too many
+func (r *ApiRateLimiter) recordBreach(store cache.Store, inst Event) (Ban, bool) {
+	now := r.eventTime(inst)
+	window := r.penalty.Within.Truncate(time.Second)
+	if window < time.Second {
+		window = time.Second
+	}
+	level := 0
+	levelKey := penaltyLevelPrefix + inst.clientId
+	if val, ok := store.Get(levelKey); ok {
+		fmt.Sscanf(val, "%d", &level)
+	}
+	// the count starts over with every ban, or a ban running out within Within would be followed by
+	// another one on the very next breach
+	breachKey := func(at time.Time) string {
+		return fmt.Sprintf("%s%s_%d_%s", penaltyBreachPrefix, timeslice.GetTimeWindowFor(at, window), level, inst.clientId)
+	}
+	current := store.IncrAndGet(breachKey(now))
+	// IncrByAndGet with 0 only reads the previous window's count
+	previous := store.IncrByAndGet(breachKey(now.Add(-window)), 0)
+	overlap := float64(timeslice.TimeLeftInWindowFor(now, window)) / float64(window)
+	if float64(current)+float64(previous)*overlap < float64(r.penalty.Breaches) {
+		return Ban{}, false
+	}
+	level++
+	duration := r.penalty.banDuration(level)
+	ban := Ban{clientId: inst.clientId, until: now.Add(duration), level: level}
+	store.Put(levelKey, fmt.Sprintf("%d", level), duration+r.penalty.resetAfter())
+	store.Put(penaltyBanPrefix+inst.clientId, encodeBan(ban), duration)
+	r.logger.Warn("client banned", "client_id", inst.clientId, "until", ban.until, "level", level, "breaches", r.penalty.Breaches)
+	return ban, true
+}
+
+// ListBans - the clients currently in the penalty box
+func (r *ApiRateLimiter) ListBans() []Ban {
+	bans := []Ban{}
+	now := r.clock.Now()
+	for _, key := range r.store.Keys(penaltyBanPrefix) {
+		val, ok := r.store.Get(key)
+		if !ok {
+			continue
+		}
+		ban, ok := decodeBan(strings.TrimPrefix(key, penaltyBanPrefix), val)
+		if ok && now.Before(ban.until) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// LiftBan - lets the client back in right away. Its past bans still count towards escalation.
+func (r *ApiRateLimiter) LiftBan(clientId string) {
+	r.store.Delete(penaltyBanPrefix + clientId)
+}
@@ -1,51 +1,186 @@
 package gatekeeper
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
 	"time"
 
 	"./cache"
+	"./clock"
+	"./logging"
+	"./metrics"
 	"./timeslice"
+	"./tracing"
 	"./types"
 )
 
+// Scope - the level of the org > client > API key hierarchy that a rule counts events at
+type Scope int
+
+const (
+	SCOPE_CLIENT Scope = iota // default
+	SCOPE_API_KEY
+	SCOPE_ORG
+	SCOPE_GLOBAL // aggregate of all clients, e.g. to protect a database behind the resource
+)
+
+// globalSubject - the subject that every event shares at SCOPE_GLOBAL
+const globalSubject = "*"
+
+// rank - narrower scopes are evaluated first
+func (s Scope) rank() int {
+	switch s {
+	case SCOPE_API_KEY:
+		return 0
+	case SCOPE_CLIENT:
+		return 1
+	case SCOPE_ORG:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func (s Scope) String() string {
+	switch s {
+	case SCOPE_API_KEY:
+		return "api_key"
+	case SCOPE_CLIENT:
+		return "client"
+	case SCOPE_ORG:
+		return "org"
+	default:
+		return "global"
+	}
+}
+
 type ClientRule struct {
 	id                    string
-	quota                 int // only quota is overridden
-	clientId              string
+	quota                 int    // always overridden
+	clientId              string // for rules at org or API key scope, this is the org id or the API key. global rules can't be overridden
 	overridenCommonRuleId string
+	// optional overrides, the common rule's values apply when unset. see ClientRule.merge
+	interval  int
+	algorithm Algorithm
+	burst     int
+	mode      Mode // a shadow override is reported on, while the common rule keeps being enforced for the client
 }
 
 type CommonRule struct {
 	id         string
 	resourceId string
-	quota      int
+	quota      int // budget per interval, in whatever unit the event cost is expressed in
 	interval   int
+	scope      Scope
+	algorithm  Algorithm
+	burst      int  // bucket size for ALGO_TOKEN_BUCKET
+	mode       Mode // MODE_SHADOW reports breaches without rejecting, to try out a rule before enforcing it
+	// optional descriptors, in the spirit of Envoy's rate limit descriptors
+	keyLabels   []string          // event labels that the counter is keyed on, e.g. "ip" makes the rule per IP
+	matchLabels map[string]string // the rule only applies to events carrying these label values
+}
+
+// matches - checks that the event carries every label that the rule keys on or filters by
+func (cmr CommonRule) matches(inst Event) bool {
+	for label, value := range cmr.matchLabels {
+		if inst.labels[label] != value {
+			return false
+		}
+	}
+	for _, label := range cmr.keyLabels {
+		if _, ok := inst.labels[label]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// dimensions - renders the label values that the rule keys on, in the order the rule declares them
+func (cmr CommonRule) dimensions(inst Event) string {
+	var dims string
+	for _, label := range cmr.keyLabels {
+		dims += fmt.Sprintf("_%s=%s", label, inst.labels[label])
+	}
+	return dims
 }
 
 type Event struct {
 	resourceId string
 	clientId   string
+	orgId      string            // optional. the org that the client belongs to
+	apiKey     string            // optional. the API key of the client that made the call
+	labels     map[string]string // optional attributes such as method, ip, region, plan or user-agent
+	timestamp  time.Time         // optional. set when replaying historical events, otherwise the limiter's clock is used
+	cost       int               // units consumed by this event (tokens, bytes, rows...). defaults to 1 when unset
+}
+
+func (e Event) weight() int {
+	if e.cost <= 0 {
+		return 1
+	}
+	return e.cost
+}
+
+// subject - the id that the event is counted against at the given scope
+func (e Event) subject(scope Scope) string {
+	switch scope {
+	case SCOPE_API_KEY:
+		return e.apiKey
+	case SCOPE_ORG:
+		return e.orgId
+	case SCOPE_GLOBAL:
+		return globalSubject
+	default:
+		return e.clientId
+	}
+}
+
+// limit - a quota that applies to an event, resolved from a common rule and the client rule overriding it
+type limit struct {
+	ruleId     string
+	quota      int
+	window     time.Duration // the interval of the rule, or the refill time of a token bucket
+	scope      Scope
+	dimensions string // rendered values of the labels that the rule keys on
+	sliding    bool   // weigh in the previous window
+	shadow     bool   // report, don't reject
 }
 
 // var localMap *types.Map
 
-func (r *ApiRateLimiter) getCurrentTimeWindow(interval int) string {
+func (r *ApiRateLimiter) getCurrentTimeWindow(window time.Duration) string {
 	// lookup the cache
-	lookupKey := fmt.Sprintf("time_interval_%d", interval)
+	lookupKey := fmt.Sprintf("time_interval_%d", window.Milliseconds())
 	val, resCode := r.trackerCheckMap.Get(lookupKey)
 	if resCode == types.HIT {
 		return val
 	} else {
-		currentWindow := timeslice.GetTimeWindow(interval)
-		r.trackerCheckMap.Put(lookupKey, currentWindow, time.Duration(interval)*time.Second)
+		now := r.clock.Now()
+		currentWindow := timeslice.GetTimeWindowFor(now, window)
+		// cache only until the window closes, so that the next one starts on time
+		r.trackerCheckMap.Put(lookupKey, currentWindow, timeslice.TimeLeftInWindowFor(now, window))
 		return currentWindow
 	}
 }
 
-func (r *ApiRateLimiter) getTracker(inst Event, ruleId string, interval int) string {
-	window := r.getCurrentTimeWindow(interval)
-	return fmt.Sprintf("%s_%s_%s_%s", window, inst.clientId, inst.resourceId, ruleId)
+func (r *ApiRateLimiter) getTracker(inst Event, l limit) string {
+	if inst.timestamp.IsZero() {
+		return r.formatTracker(r.getCurrentTimeWindow(l.window), inst, l)
+	}
+	// replayed events carry their own time, the cached current window doesn't apply
+	return r.getTrackerAt(inst.timestamp, inst, l)
+}
+
+// getTrackerAt - the tracker of the window containing the given instant
+func (r *ApiRateLimiter) getTrackerAt(t time.Time, inst Event, l limit) string {
+	return r.formatTracker(timeslice.GetTimeWindowFor(t, l.window), inst, l)
+}
+
+func (r *ApiRateLimiter) formatTracker(window string, inst Event, l limit) string {
+	return fmt.Sprintf("%s_%s_%s_%s%s", window, inst.subject(l.scope), inst.resourceId, l.ruleId, l.dimensions)
 }
 
 func (r *ApiRateLimiter) getCommonRuleById(id string) (CommonRule, bool) {
@@ -58,39 +193,74 @@ func (r *ApiRateLimiter) getCommonRuleById(id string) (CommonRule, bool) {
 
 func (r *ApiRateLimiter) findMatchingClientRules(inst Event) []ClientRule {
 	result := []ClientRule{}
-	for _, clientRule := range r.clrules {
-		cmr, ok := r.getCommonRuleById(clientRule.overridenCommonRuleId)
-		if ok && cmr.resourceId == inst.resourceId {
-			result = append(result, clientRule)
+	for _, scope := range overridableScopes {
+		subject := inst.subject(scope)
+		if subject == "" {
+			continue
 		}
+		result = append(result, r.clientRulesIdx[clientRuleKey{resourceId: inst.resourceId, scope: scope, subject: subject}]...)
 	}
 	return result
 }
 
 func (r *ApiRateLimiter) findMatchingCommonRules(evt Event) []CommonRule {
-	if cmr, ok := r.commonRulesIdxByResourceId[evt.resourceId]; ok {
-		return []CommonRule{cmr}
+	if cmrs, ok := r.commonRulesIdxByResourceId[evt.resourceId]; ok {
+		return cmrs
 	} else {
 		return []CommonRule{}
 	}
 }
 
 func removeOverriddenCommonRules(commonRules []CommonRule, clientRules []ClientRule) []CommonRule {
+	if len(clientRules) == 0 {
+		return commonRules
+	}
+	overridden := make(map[string]bool, len(clientRules))
+	for _, clientRule := range clientRules {
+		overridden[clientRule.overridenCommonRuleId] = true
+	}
 	matching := []CommonRule{}
 	for _, commonRule := range commonRules {
-		matches := false
-		for _, clientRule := range clientRules {
-			if clientRule.overridenCommonRuleId == commonRule.id {
-				matches = true
-			}
-		}
-		if matches == false {
+		if overridden[commonRule.id] == false {
 			matching = append(matching, commonRule)
 		}
 	}
 	return matching
 }
 
+// findLimits - resolves the rules matching the event into the limits to check, narrowest scope first
+func (r *ApiRateLimiter) findLimits(inst Event) []limit {
+	r.rulesLock.RLock()
+	defer r.rulesLock.RUnlock()
+	matchingCommonRules := r.findMatchingCommonRules(inst)
+	matchingClientRules := r.findMatchingClientRules(inst)
+	replacingClientRules := []ClientRule{}
+	for _, clr := range matchingClientRules {
+		cmr, _ := r.getCommonRuleById(clr.overridenCommonRuleId)
+		if clr.replaces(cmr) {
+			replacingClientRules = append(replacingClientRules, clr)
+		}
+	}
+	prunedCommonRules := removeOverriddenCommonRules(matchingCommonRules, replacingClientRules)
+	limits := []limit{}
+	for _, cmr := range prunedCommonRules {
+		if inst.subject(cmr.scope) == "" || !cmr.matches(inst) {
+			// the event doesn't carry an id at this level of the hierarchy, or the labels the rule needs
+			continue
+		}
+		limits = append(limits, cmr.toLimit(inst))
+	}
+	for _, clr := range matchingClientRules {
+		cmr, _ := r.getCommonRuleById(clr.overridenCommonRuleId)
+		if !cmr.matches(inst) {
+			continue
+		}
+		limits = append(limits, clr.merge(cmr).toLimit(inst))
+	}
+	sort.SliceStable(limits, func(i, j int) bool { return limits[i].scope.rank() < limits[j].scope.rank() })
+	return limits
+}
+
 type StoreType int
 
 const (
@@ -99,27 +269,63 @@ const (
 	STORE_SYNCED_MEMORY
 )
 
+// storeNames - how the stores are labelled in metrics
+var storeNames = map[StoreType]string{STORE_REDIS: "redis", STORE_MEMORY: "memory", STORE_SYNCED_MEMORY: "synced_memory"}
+
 type Result struct {
 	hasBreached    bool
 	breachedRuleId string
+	breachedScope  Scope // the level of the hierarchy that breached
 	quota          int
 	currentCount   int
+	shadowBreaches []string // shadow rules that would have rejected the event
+	banned         bool     // the client is in the penalty box
+	bannedUntil    time.Time
+	allowlisted    bool   // an ACCESS_ALLOW rule let the event through without counting it
+	denylisted     bool   // an ACCESS_DENY rule rejected the event
+	accessRuleId   string // the access rule that decided the event
 }
 
 type RateLimiter interface {
-	// TODO
-	// AddCommonRules(cmrules []CommonRule)
-	// AddClientRules(clrules []ClientRule)
+	AddCommonRules(cmrules []CommonRule) error
+	AddClientRules(clrules []ClientRule) error
 	RecordEventAndCheck(evt Event) Result
+	RecordEventAndCheckContext(ctx context.Context, evt Event) Result
 }
 
 type ApiRateLimiter struct {
 	commonRulesIdxById         map[string]CommonRule
-	commonRulesIdxByResourceId map[string]CommonRule
+	commonRulesIdxByResourceId map[string][]CommonRule
+	clientRulesIdxById         map[string]ClientRule
+	clientRulesIdx             map[clientRuleKey][]ClientRule
 	cmrules                    []CommonRule
-	clrules                    []ClientRule
+	accessRules                []accessEntry
+	rulesLock                  sync.RWMutex
 	store                      cache.Store
 	trackerCheckMap            *types.Map
+	clock                      clock.Clock
+	penalty                    *PenaltyConfig
+	metrics                    metrics.Collector
+	tracer                     tracing.Tracer
+	logger                     *slog.Logger
+	hooks                      hooks
+	syncedMemory               *cache.SyncedMemory // set for STORE_SYNCED_MEMORY, which knows of the peers
+}
+
+// LimiterConfig - optional settings for NewApiRateLimiterWithConfig
+type LimiterConfig struct {
+	StoreType StoreType
+	Clock     clock.Clock       // defaults to the system clock. use clock.NewFakeClock for tests and replays
+	Penalty   *PenaltyConfig    // optional. temporary bans for repeat offenders
+	Access    []AccessRule      // optional. allowlist and denylist
+	Metrics   metrics.Collector // optional. e.g. prom.NewCollector to export to Prometheus
+	Tracer    tracing.Tracer    // optional. e.g. otel.NewTracer to export spans to OpenTelemetry
+	Logger    *slog.Logger      // optional. defaults to slog.Default(), which leaves the per-event debug logs off
+	Namespace string            // optional. keeps the keys and the sync stream apart from other limiters sharing the Redis
+	NodeID    string            // optional. identifies this node to its peers with STORE_SYNCED_MEMORY
+	// SyncTransport - optional. carries the counts of STORE_SYNCED_MEMORY in place of the Redis stream, e.g.
+	// cache.NewGossipTransport. Without Redis, bans are only honoured by the node that issued them
+	SyncTransport cache.Transport
 }
 
 func init() {
@@ -129,62 +335,229 @@ func init() {
 }
 
 func NewApiRateLimiter(cmrs []CommonRule, clrs []ClientRule, storeType StoreType) *ApiRateLimiter {
+	return NewApiRateLimiterWithConfig(cmrs, clrs, &LimiterConfig{StoreType: storeType})
+}
+
+// NewApiRateLimiterWithConfig - same as NewApiRateLimiter, with the extra knobs in LimiterConfig.
+// Rules failing ValidateRules are logged and ignored.
+func NewApiRateLimiterWithConfig(cmrs []CommonRule, clrs []ClientRule, config *LimiterConfig) *ApiRateLimiter {
+	logger := logging.OrDefault(config.Logger)
+	cmrs, clrs, errs := validRules(cmrs, clrs)
+	for _, err := range errs {
+		logger.Warn("ignoring invalid rule", "error", err)
+	}
 	maxTTL := time.Duration(300 * time.Second)
+	clk := clock.OrSystem(config.Clock)
+	collector := metrics.OrNop(config.Metrics)
 	var store cache.Store
-	if storeType == STORE_REDIS {
+	var syncedMemory *cache.SyncedMemory
+	if config.StoreType == STORE_REDIS {
 		store = cache.NewRedisStore(*cache.DevConfig())
-	} else if storeType == STORE_SYNCED_MEMORY {
-		config := cache.SyncMemoryConfig{MaxTTL: maxTTL, FlushInterval: time.Duration(1 * time.Second)}
-		store = cache.NewSyncedMemory(&config, cache.DevConfig())
-	} else if storeType == STORE_MEMORY {
-		store = cache.NewCache(time.Duration(300 * time.Second))
+		if config.Namespace != "" {
+			store = cache.NewNamespacedStore(store, config.Namespace)
+		}
+	} else if config.StoreType == STORE_SYNCED_MEMORY {
+		syncConfig := cache.SyncMemoryConfig{MaxTTL: maxTTL, FlushInterval: time.Duration(1 * time.Second), Clock: clk, Metrics: collector, Logger: logger, Namespace: config.Namespace, NodeID: config.NodeID, Transport: config.SyncTransport}
+		redisConfig := cache.DevConfig()
+		if config.SyncTransport != nil {
+			redisConfig = nil
+		}
+		syncedMemory = cache.NewSyncedMemory(&syncConfig, redisConfig)
+		store = syncedMemory
+	} else if config.StoreType == STORE_MEMORY {
+		store = cache.NewCacheWithConfig(time.Duration(300*time.Second), cache.CacheConfig{Clock: clk, Logger: logger})
+	}
+	if config.Metrics != nil {
+		store = cache.NewInstrumentedStore(store, storeNames[config.StoreType], collector)
 	}
-	limiter := ApiRateLimiter{cmrules: cmrs, clrules: clrs}
+	if config.Tracer != nil {
+		store = cache.NewTracedStore(store, storeNames[config.StoreType], config.Tracer)
+	}
+	limiter := ApiRateLimiter{cmrules: cmrs, clock: clk, metrics: collector, tracer: tracing.OrNop(config.Tracer), logger: logger}
 	limiter.store = store
-	limiter.commonRulesIdxById = make(map[string]CommonRule)
-	limiter.commonRulesIdxByResourceId = make(map[string]CommonRule)
-	limiter.trackerCheckMap = types.NewMap()
-	for _, cmr := range cmrs {
-		limiter.commonRulesIdxById[cmr.id] = cmr
-		limiter.commonRulesIdxByResourceId[cmr.resourceId] = cmr
+	limiter.syncedMemory = syncedMemory
+	limiter.trackerCheckMap = types.NewMapWithClock(clk)
+	if config.Penalty != nil {
+		if err := config.Penalty.validate(); err != nil {
+			logger.Warn("penalty box disabled", "error", err)
+		} else {
+			limiter.penalty = config.Penalty
+		}
+	}
+	for _, ar := range config.Access {
+		if err := limiter.AddAccessRules([]AccessRule{ar}); err != nil {
+			logger.Warn("ignoring invalid rule", "error", err)
+		}
+	}
+	limiter.clientRulesIdxById = make(map[string]ClientRule)
+	for _, clr := range clrs {
+		limiter.clientRulesIdxById[clr.id] = clr
 	}
+	limiter.reindex()
 	return &limiter
 }
 
 func (r *ApiRateLimiter) RecordEventAndCheck(inst Event) Result {
-	matchingCommonRules := r.findMatchingCommonRules(inst)
-	matchingClientRules := r.findMatchingClientRules(inst)
-	prunedCommonRules := removeOverriddenCommonRules(matchingCommonRules, matchingClientRules)
+	return r.RecordEventAndCheckContext(context.Background(), inst)
+}
+
+// RecordEventAndCheckContext - same as RecordEventAndCheck. The decision and the store calls it makes
+// are traced as children of the span in the given context.
+func (r *ApiRateLimiter) RecordEventAndCheckContext(ctx context.Context, inst Event) Result {
+	res, _ := r.recordEvent(ctx, "RecordEventAndCheck", inst)
+	return res
+}
+
+// Peers - the other hosts this one shares its counts with. Only STORE_SYNCED_MEMORY has any
+func (r *ApiRateLimiter) Peers() []cache.Peer {
+	if r.syncedMemory == nil {
+		return []cache.Peer{}
+	}
+	return r.syncedMemory.Peers()
+}
+
+// SyncHealth - how the sharing of counts with the peers is going. Only STORE_SYNCED_MEMORY shares them
+func (r *ApiRateLimiter) SyncHealth() (cache.SyncHealth, bool) {
+	if r.syncedMemory == nil {
+		return cache.SyncHealth{}, false
+	}
+	return r.syncedMemory.Health(), true
+}
+
+// storeFor - the store, with its calls bound to the given context when it supports that
+func (r *ApiRateLimiter) storeFor(ctx context.Context) cache.Store {
+	if cs, ok := r.store.(cache.ContextStore); ok {
+		return cs.WithContext(ctx)
+	}
+	return r.store
+}
+
+// trackedCounter - a counter that an event was recorded against, along with the window it belongs to
+type trackedCounter struct {
+	limit     limit
+	tracker   string
+	windowEnd time.Time
+	refunded  bool // the event was rejected and taken back off the counter
+}
+
+func (r *ApiRateLimiter) eventTime(inst Event) time.Time {
+	if inst.timestamp.IsZero() {
+		return r.clock.Now()
+	}
+	return inst.timestamp
+}
+
+func (r *ApiRateLimiter) track(inst Event, l limit) trackedCounter {
+	now := r.eventTime(inst)
+	return trackedCounter{
+		limit:     l,
+		tracker:   r.getTracker(inst, l),
+		windowEnd: now.Add(timeslice.TimeLeftInWindowFor(now, l.window)),
+	}
+}
+
+// recordEvent - records the event within a span named after the calling API
+func (r *ApiRateLimiter) recordEvent(ctx context.Context, operation string, inst Event) (Result, []trackedCounter) {
+	ctx, span := r.tracer.Start(ctx, "gatekeeper."+operation)
+	defer span.End()
+	res, counters := r.evaluate(r.storeFor(ctx), inst)
+	ruleIds := []string{}
+	for _, counter := range counters {
+		ruleIds = append(ruleIds, counter.limit.ruleId)
+	}
+	span.SetAttribute("resource_id", inst.resourceId)
+	span.SetAttribute("client_id", inst.clientId)
+	span.SetAttribute("cost", inst.weight())
+	span.SetAttribute("rule_ids", ruleIds)
+	span.SetAttribute("breached", res.hasBreached)
+	span.SetAttribute("breached_rule_id", res.breachedRuleId)
+	span.SetAttribute("current_count", res.currentCount)
+	span.SetAttribute("shadow_breaches", res.shadowBreaches)
+	span.SetAttribute("banned", res.banned)
+	span.SetAttribute("access_rule_id", res.accessRuleId)
+	return res, counters
+}
+
+// evaluate - records the event against every matching rule, and returns the counters it touched.
+// The API key, client and org levels are all checked, and the first one to breach rejects the event.
+func (r *ApiRateLimiter) evaluate(store cache.Store, inst Event) (Result, []trackedCounter) {
 	var val int
+	counters := []trackedCounter{}
+	shadowBreaches := []string{}
+	if rule, ok := r.checkAccess(inst); ok {
+		if rule.access == ACCESS_DENY {
+			r.metrics.ObserveDecision(rule.id, metrics.DENYLISTED)
+			return Result{hasBreached: true, denylisted: true, accessRuleId: rule.id}, counters
+		}
+		r.metrics.ObserveDecision(rule.id, metrics.ALLOWLISTED)
+		return Result{allowlisted: true, accessRuleId: rule.id}, counters
+	}
+	if r.penalty != nil && inst.clientId != "" {
+		// banned clients are turned away before any counter is touched
+		if ban, ok := r.checkBan(store, inst); ok {
+			r.metrics.ObserveDecision(penaltyBoxRuleId, metrics.BANNED)
+			return Result{hasBreached: true, banned: true, bannedUntil: ban.until}, counters
+		}
+	}
 	// now we have to execute the match against common & client specific
 	// all matching rules are fair game
-	for _, cmr := range prunedCommonRules {
-		trackId := r.getTracker(inst, cmr.id, cmr.interval)
-		val = r.store.IncrAndGet(trackId)
-		// fmt.Printf("Current count is %s :: %d, quota is %d\n" , trackId, val, cmr.quota)
-		if val > cmr.quota {
+	for _, l := range r.findLimits(inst) {
+		counter := r.track(inst, l)
+		counters = append(counters, counter)
+		val = store.IncrByAndGet(counter.tracker, inst.weight())
+		if l.sliding {
+			val = r.slidingCount(store, inst, l, val)
+		}
+		// fmt.Printf("Current count is %s :: %d, quota is %d\n" , trackId, val, l.quota)
+		if val <= l.quota {
+			r.metrics.ObserveDecision(l.ruleId, metrics.ALLOWED)
+			if !l.shadow {
+				r.notifyNearLimit(inst, l, val)
+			}
+		} else if l.shadow {
+			if l.sliding {
+				// as it would be, were the rule enforced
+				r.refund(store, inst, counters[len(counters)-1:])
+			}
+			r.logger.Debug("shadow rule breached", "rule_id", l.ruleId, "subject", inst.subject(l.scope), "count", val, "quota", l.quota)
+			r.metrics.ObserveDecision(l.ruleId, metrics.SHADOW_THROTTLED)
+			r.notifyShadowBreach(inst, l, val)
+			shadowBreaches = append(shadowBreaches, l.ruleId)
+		} else {
 			// this is a breach
-			return returnBreach(cmr.id, cmr.quota, val)
+			r.metrics.ObserveDecision(l.ruleId, metrics.THROTTLED)
+			r.refund(store, inst, counters)
+			res := returnBreach(l, val, shadowBreaches)
+			r.notifyBreach(inst, l, val)
+			if r.penalty != nil && inst.clientId != "" {
+				if ban, ok := r.recordBreach(store, inst); ok {
+					res.banned = true
+					res.bannedUntil = ban.until
+					r.notifyBanned(inst, l, ban)
+				}
+			}
+			return res, counters
 		}
 	}
+	return returnNoBreach(val, shadowBreaches), counters
+}
 
-	for _, clr := range matchingClientRules {
-		cmr, _ := r.getCommonRuleById(clr.overridenCommonRuleId)
-		trackId := r.getTracker(inst, clr.id, cmr.interval)
-		val = r.store.IncrAndGet(trackId)
-		// fmt.Printf("Current count is %s :: %d, quota is %d\n" , trackId, val, clr.quota)
-		if val > clr.quota {
-			// this is a breach
-			return returnBreach(clr.id, clr.quota, val)
+// refund - takes a rejected event back off the sliding counters it was added to. Sliding limits weigh the
+// previous window in, so rejected events left there would keep a client over its quota for as long as it
+// keeps trying. Fixed windows start over regardless, and keep counting them
+func (r *ApiRateLimiter) refund(store cache.Store, inst Event, counters []trackedCounter) {
+	for i := range counters {
+		if counters[i].limit.sliding {
+			store.DecrByAndGet(counters[i].tracker, inst.weight())
+			counters[i].refunded = true
 		}
 	}
-	return returnNoBreach(val)
 }
 
-func returnBreach(ruleId string, quota int, currentCount int) Result {
-	return Result{hasBreached: true, breachedRuleId: ruleId, quota: quota, currentCount: currentCount}
+func returnBreach(l limit, currentCount int, shadowBreaches []string) Result {
+	return Result{hasBreached: true, breachedRuleId: l.ruleId, breachedScope: l.scope, quota: l.quota, currentCount: currentCount, shadowBreaches: shadowBreaches}
 }
 
-func returnNoBreach(val int) Result {
-	return Result{hasBreached: false, currentCount: val}
+func returnNoBreach(val int, shadowBreaches []string) Result {
+	return Result{hasBreached: false, currentCount: val, shadowBreaches: shadowBreaches}
 }
@@ -1,16 +1,33 @@
 package gatekeeper
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"./cache"
+	"./clock"
+	"./metrics"
+	"./notify"
+	"./tracing/otel"
+	"./types"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func getCommonRules() []CommonRule {
@@ -118,6 +135,40 @@ func BenchmarkEvents10mnWithSyncMemory(b *testing.B) {
 	benchmarkRateCountingOnStore(10*1000*1000, STORE_SYNCED_MEMORY, b)
 }
 
+// getManyClientRules - one override per client, spread over the first 100 resources
+func getManyClientRules(count int) []ClientRule {
+	clrules := []ClientRule{}
+	for i := 0; i < count; i++ {
+		ruleId := fmt.Sprintf("cl%d", i)
+		clientId := fmt.Sprintf("dp%d", i)
+		commonRuleId := fmt.Sprintf("cr%d", 4+i%96)
+		clrules = append(clrules, ClientRule{id: ruleId, clientId: clientId, quota: 100, overridenCommonRuleId: commonRuleId})
+	}
+	return clrules
+}
+
+func benchmarkRateCountingWithClientRules(clientRuleCount int, b *testing.B) {
+	limiter := NewApiRateLimiter(getCommonRules(), getManyClientRules(clientRuleCount), STORE_MEMORY)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newinst := Event{resourceId: fmt.Sprintf("api/call%d", 4+i%96), clientId: fmt.Sprintf("dp%d", i%clientRuleCount)}
+		result = limiter.RecordEventAndCheck(newinst)
+	}
+}
+
+func BenchmarkEventsWith1kClientRules(b *testing.B) { benchmarkRateCountingWithClientRules(1000, b) }
+func BenchmarkEventsWith50kClientRules(b *testing.B) {
+	benchmarkRateCountingWithClientRules(50*1000, b)
+}
+
+func BenchmarkAddClientRulesTo50k(b *testing.B) {
+	limiter := NewApiRateLimiter(getCommonRules(), getManyClientRules(50*1000), STORE_MEMORY)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		limiter.AddClientRules([]ClientRule{{id: fmt.Sprintf("cl%d", i%50000), clientId: fmt.Sprintf("dp%d", i%50000), quota: 200, overridenCommonRuleId: "cr4"}})
+	}
+}
+
 func BenchmarkEvents5mn(b *testing.B) { benchmarkRateCounting(5*1000*1000, b) }
 
 // 5million takes >100s to run on a typical laptop
@@ -127,14 +178,15 @@ func TestBreachAndReset(t *testing.T) {
 	fmt.Println("Commencing test for breach & reset")
 	cmrules := getCommonRules()
 	clrules := getClientRules()
-	limiter := NewApiRateLimiter(cmrules, clrules, STORE_SYNCED_MEMORY)
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, clrules, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Clock: clk})
 	rule1 := cmrules[0]
 
 	inst := Event{resourceId: "api/call1", clientId: "dp1"}
 
 	for i := 0; i < 40; i++ {
 		result := limiter.RecordEventAndCheck(inst)
-		time.Sleep(1 * time.Millisecond)
+		clk.Advance(1 * time.Millisecond)
 		// given quota is 20. So breach is when i exceeds 20
 		if i > 20 {
 			var expectedResult = true
@@ -144,14 +196,1158 @@ func TestBreachAndReset(t *testing.T) {
 			}
 		}
 	}
-	fmt.Printf("Waiting for %d seconds\n", rule1.interval)
-	time.Sleep(time.Duration(10) * time.Second)
+	fmt.Printf("Advancing the clock by %d seconds\n", rule1.interval)
+	clk.Advance(time.Duration(rule1.interval) * time.Second)
 	result := limiter.RecordEventAndCheck(inst)
 	if result.hasBreached == true {
 		t.Fatalf("The count is not clearing as expected")
 	}
 }
 
+func TestReplayWithEventTimestamp(t *testing.T) {
+	rule1 := CommonRule{id: "cr1", resourceId: "api/call1", quota: 2, interval: 10}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig([]CommonRule{rule1}, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+
+	// events from an old log, replayed long after they happened
+	logStart := time.Unix(1553000000, 0)
+	offsets := []int{0, 1, 2, 11, 12}
+	expected := []bool{false, false, true, false, false}
+	for i, offset := range offsets {
+		inst := Event{resourceId: "api/call1", clientId: "dp1", timestamp: logStart.Add(time.Duration(offset) * time.Second)}
+		res := limiter.RecordEventAndCheck(inst)
+		isEqual(expected[i], res.hasBreached, t)
+	}
+}
+
+func TestWeightedEvents(t *testing.T) {
+	// budget of 1000 tokens every 10 seconds
+	rule1 := CommonRule{id: "cr1", resourceId: "api/completions", quota: 1000, interval: 10}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig([]CommonRule{rule1}, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+
+	res := limiter.RecordEventAndCheck(Event{resourceId: "api/completions", clientId: "dp1", cost: 600})
+	isEqual(false, res.hasBreached, t)
+	isEqual(600, res.currentCount, t)
+
+	// an event without a cost counts as 1
+	res = limiter.RecordEventAndCheck(Event{resourceId: "api/completions", clientId: "dp1"})
+	isEqual(601, res.currentCount, t)
+
+	res = limiter.RecordEventAndCheck(Event{resourceId: "api/completions", clientId: "dp1", cost: 400})
+	isEqual(true, res.hasBreached, t)
+	isEqual(1001, res.currentCount, t)
+}
+
+func TestReserveCommitAndCancel(t *testing.T) {
+	rule1 := CommonRule{id: "cr1", resourceId: "api/export", quota: 100, interval: 10}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig([]CommonRule{rule1}, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	inst := Event{resourceId: "api/export", clientId: "dp1"}
+
+	reservation, res := limiter.Reserve(inst, 50)
+	isEqual(50, res.currentCount, t)
+	reservation.Commit(20) // refunds 30
+	reservation.Commit(90) // settling twice is a no-op
+
+	reservation, res = limiter.Reserve(inst, 50)
+	isEqual(70, res.currentCount, t)
+	reservation.Cancel()
+
+	reservation, res = limiter.Reserve(inst, 10)
+	isEqual(30, res.currentCount, t)
+	reservation.Commit(40) // charges 30 more
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(61, res.currentCount, t)
+
+	// the window closes before the actual cost is known
+	reservation, _ = limiter.Reserve(inst, 10)
+	clk.Advance(10 * time.Second)
+	reservation.Commit(25)
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(16, res.currentCount, t)
+
+	reservation, _ = limiter.Reserve(inst, 10)
+	clk.Advance(10 * time.Second)
+	reservation.Cancel()
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(1, res.currentCount, t)
+}
+
+func TestHierarchicalQuotas(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "org", resourceId: "api/call1", quota: 4, interval: 10, scope: SCOPE_ORG},
+		{id: "client", resourceId: "api/call1", quota: 3, interval: 10, scope: SCOPE_CLIENT},
+		{id: "key", resourceId: "api/call1", quota: 2, interval: 10, scope: SCOPE_API_KEY},
+	}
+	// dp2 is a bigger client, its override raises the client level quota
+	clrules := []ClientRule{{id: "client-dp2", clientId: "dp2", quota: 10, overridenCommonRuleId: "client"}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, clrules, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+
+	key1 := Event{resourceId: "api/call1", orgId: "acme", clientId: "dp1", apiKey: "k1"}
+	key2 := Event{resourceId: "api/call1", orgId: "acme", clientId: "dp1", apiKey: "k2"}
+	key3 := Event{resourceId: "api/call1", orgId: "acme", clientId: "dp2", apiKey: "k3"}
+
+	limiter.RecordEventAndCheck(key1)
+	limiter.RecordEventAndCheck(key1)
+	res := limiter.RecordEventAndCheck(key1)
+	isEqual(true, res.hasBreached, t)
+	isEqual(SCOPE_API_KEY, res.breachedScope, t)
+	isEqual("key", res.breachedRuleId, t)
+
+	// the third call from k1 was rejected at the key level, so dp1 has used 2 of its 3
+	isEqual(false, limiter.RecordEventAndCheck(key2).hasBreached, t)
+	res = limiter.RecordEventAndCheck(key2)
+	isEqual(true, res.hasBreached, t)
+	isEqual(SCOPE_CLIENT, res.breachedScope, t)
+
+	// rejected calls stop at the level that breached, so acme has used 3 of its 4
+	isEqual(false, limiter.RecordEventAndCheck(key3).hasBreached, t)
+	res = limiter.RecordEventAndCheck(key3)
+	isEqual(true, res.hasBreached, t)
+	isEqual(SCOPE_ORG, res.breachedScope, t)
+	isEqual("org", res.breachedRuleId, t)
+}
+
+func TestLabelDimensions(t *testing.T) {
+	cmrules := []CommonRule{
+		// per IP per resource, only for writes
+		{id: "writes-per-ip", resourceId: "api/orders", quota: 2, interval: 10, keyLabels: []string{"ip"}, matchLabels: map[string]string{"method": "POST"}},
+	}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+
+	post1 := Event{resourceId: "api/orders", clientId: "dp1", labels: map[string]string{"method": "POST", "ip": "10.0.0.1"}}
+	post2 := Event{resourceId: "api/orders", clientId: "dp1", labels: map[string]string{"method": "POST", "ip": "10.0.0.2"}}
+	get1 := Event{resourceId: "api/orders", clientId: "dp1", labels: map[string]string{"method": "GET", "ip": "10.0.0.1"}}
+
+	limiter.RecordEventAndCheck(post1)
+	limiter.RecordEventAndCheck(post1)
+	isEqual(true, limiter.RecordEventAndCheck(post1).hasBreached, t)
+	// a different IP has its own counter
+	isEqual(1, limiter.RecordEventAndCheck(post2).currentCount, t)
+	// reads don't match the rule at all
+	for i := 0; i < 5; i++ {
+		isEqual(false, limiter.RecordEventAndCheck(get1).hasBreached, t)
+	}
+}
+
+func TestGlobalLimits(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "per-client", resourceId: "api/search", quota: 3, interval: 10},
+		{id: "all-clients", resourceId: "api/search", quota: 4, interval: 10, scope: SCOPE_GLOBAL},
+		{id: "per-region", resourceId: "api/search", quota: 1, interval: 10, scope: SCOPE_GLOBAL, keyLabels: []string{"region"}},
+	}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp1"}).hasBreached, t)
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp2"}).hasBreached, t)
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp3"}).hasBreached, t)
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp4", labels: map[string]string{"region": "eu"}}).hasBreached, t)
+	// every client is well within its own quota, but the resource as a whole is not
+	res := limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp5"})
+	isEqual(true, res.hasBreached, t)
+	isEqual("all-clients", res.breachedRuleId, t)
+	isEqual(SCOPE_GLOBAL, res.breachedScope, t)
+
+	clk.Advance(10 * time.Second)
+	limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp1", labels: map[string]string{"region": "eu"}})
+	res = limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp2", labels: map[string]string{"region": "eu"}})
+	isEqual(true, res.hasBreached, t)
+	isEqual("per-region", res.breachedRuleId, t)
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/search", clientId: "dp2", labels: map[string]string{"region": "us"}}).hasBreached, t)
+}
+
+func TestGlobalLimitsOnSyncedMemory(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 60, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+
+	os.Setenv("HOST", "H1")
+	limiter1 := NewApiRateLimiter(cmrules, []ClientRule{}, STORE_SYNCED_MEMORY)
+	os.Setenv("HOST", "H2")
+	limiter2 := NewApiRateLimiter(cmrules, []ClientRule{}, STORE_SYNCED_MEMORY)
+
+	// different clients on different hosts add up to the same global count
+	for i := 0; i < 6; i++ {
+		limiter1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+		limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"})
+	}
+	time.Sleep(4 * time.Second)
+	b1 := limiter1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp3"})
+	b2 := limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp4"})
+	isEqual(true, b1.hasBreached, t)
+	isEqual(true, b2.hasBreached, t)
+}
+
+func TestBootstrapOfLateJoiner(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 60, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+	config := func() *LimiterConfig { return &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Namespace: "late-joiner"} }
+
+	os.Setenv("HOST", "H1")
+	limiter1 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config())
+	for i := 0; i < 5; i++ {
+		limiter1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+	}
+	time.Sleep(2 * time.Second)
+	// H2 replays the first delta of H1 before it starts serving
+	os.Setenv("HOST", "H2")
+	limiter2 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config())
+	isEqual(6, limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+	limiter1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+	time.Sleep(3 * time.Second)
+	isEqual(8, limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+}
+
+func TestPeerDeparture(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 3600, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+	// H1 flushes only when its clock is advanced
+	clk1 := clock.NewFakeClock(time.Now())
+	os.Setenv("HOST", "H1")
+	limiter1 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Clock: clk1, Namespace: "departure"})
+	os.Setenv("HOST", "H2")
+	limiter2 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Namespace: "departure"})
+
+	for i := 0; i < 6; i++ {
+		limiter1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+	}
+	clk1.Advance(time.Second)
+	time.Sleep(2 * time.Second)
+	peers := limiter2.Peers()
+	isEqual(1, len(peers), t)
+	isEqual("H1", peers[0].NodeID, t)
+	isEqual(7, limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+
+	// H1 has gone quiet, as if its pod was gone, and stops counting towards the total
+	time.Sleep(4 * time.Second)
+	isEqual(0, len(limiter2.Peers()), t)
+	isEqual(2, limiter2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+}
+
+func TestNodeRestart(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 3600, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+	config := func(nodeId string) *LimiterConfig {
+		return &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Namespace: "restart", NodeID: nodeId}
+	}
+	observer := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config("observer"))
+	before := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config("node-1"))
+	for i := 0; i < 5; i++ {
+		before.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+	}
+	time.Sleep(3 * time.Second)
+	isEqual(6, observer.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+
+	// node-1 comes back with nothing counted. the counts of its earlier run are dropped, and the earlier run
+	// is not heard from any more, though it is still around here
+	NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config("node-1"))
+	time.Sleep(3 * time.Second)
+	isEqual(2, observer.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).currentCount, t)
+	isEqual(1, len(observer.Peers()), t)
+}
+
+func TestNamespacedFleetsOnSyncedMemory(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 60, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+	fleet := func(namespace string) (*ApiRateLimiter, *ApiRateLimiter) {
+		os.Setenv("HOST", namespace+"-H1")
+		l1 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Namespace: namespace})
+		os.Setenv("HOST", namespace+"-H2")
+		l2 := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, Namespace: namespace})
+		return l1, l2
+	}
+	a1, a2 := fleet("tenant-a")
+	b1, b2 := fleet("tenant-b")
+
+	// fleet a uses up its global quota between its hosts, fleet b only sees its own events
+	for i := 0; i < 6; i++ {
+		a1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+		a2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"})
+	}
+	b1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+	time.Sleep(4 * time.Second)
+	isEqual(true, a1.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp3"}).hasBreached, t)
+	isEqual(true, a2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp4"}).hasBreached, t)
+	res := b2.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp3"})
+	isEqual(false, res.hasBreached, t)
+	isEqual(2, res.currentCount, t)
+}
+
+func TestGlobalLimitsOverGossip(t *testing.T) {
+	rule1 := CommonRule{id: "all-clients", resourceId: "api/call1", quota: 10, interval: 3600, scope: SCOPE_GLOBAL}
+	cmrules := []CommonRule{rule1}
+	for i, network := range []string{cache.GOSSIP_UDP, cache.GOSSIP_TCP} {
+		// n3 only knows of n1, and is known to n2 through it
+		addrs := []string{fmt.Sprintf("127.0.0.1:%d", 17946+3*i), fmt.Sprintf("127.0.0.1:%d", 17947+3*i), fmt.Sprintf("127.0.0.1:%d", 17948+3*i)}
+		seeds := [][]string{{addrs[1]}, {addrs[0]}, {addrs[0]}}
+		limiters := []*ApiRateLimiter{}
+		for n := range addrs {
+			transport, err := cache.NewGossipTransport(cache.GossipConfig{BindAddr: addrs[n], Seeds: seeds[n], Network: network})
+			isEqual(nil, err, t)
+			config := &LimiterConfig{StoreType: STORE_SYNCED_MEMORY, NodeID: fmt.Sprintf("%s-n%d", network, n+1), SyncTransport: transport}
+			limiters = append(limiters, NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, config))
+		}
+		for i := 0; i < 4; i++ {
+			for n, limiter := range limiters {
+				limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: fmt.Sprintf("dp%d", n)})
+			}
+		}
+		// n2 and n3 hear of each other a flush after n1 has heard from both, and then ask for a snapshot
+		time.Sleep(6 * time.Second)
+		for _, limiter := range limiters {
+			isEqual(2, len(limiter.Peers()), t)
+			res := limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp9"})
+			isEqual(13, res.currentCount, t)
+			isEqual(true, res.hasBreached, t)
+			health, _ := limiter.SyncHealth()
+			isEqual(cache.SYNC_HEALTHY, health.State, t)
+			limiter.syncedMemory.Close()
+		}
+	}
+}
+
+func TestGossipRejectsOversizedFrames(t *testing.T) {
+	transport, err := cache.NewGossipTransport(cache.GossipConfig{BindAddr: "127.0.0.1:17952", Network: cache.GOSSIP_TCP})
+	isEqual(nil, err, t)
+	isEqual(nil, transport.Connect(0), t)
+	defer transport.Close()
+	conn, err := net.Dial("tcp", "127.0.0.1:17952")
+	isEqual(nil, err, t)
+	defer conn.Close()
+	// a length prefix of 4GB, with no frame behind it
+	conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// counterOp - an increment or decrement of a replica of a PN counter, as generated by testing/quick
+type counterOp struct {
+	Node   uint8
+	Amount uint8
+	Decr   bool
+}
+
+const counterReplicas = 4
+
+// applyCounterOp - decrements are capped at the node's own contribution, as with SyncedMemory.DecrByAndGet
+func applyCounterOp(counter *types.PNCounter, node string, op counterOp) int {
+	amount := int(op.Amount)
+	if !op.Decr {
+		counter.Incr(node, amount)
+		return amount
+	}
+	if local := counter.NodeValue(node); local < amount {
+		amount = local
+	}
+	counter.Decr(node, amount)
+	return -amount
+}
+
+func replicaOf(ops []counterOp) *types.PNCounter {
+	counter := types.NewPNCounter()
+	for _, op := range ops {
+		applyCounterOp(counter, fmt.Sprintf("n%d", op.Node%counterReplicas), op)
+	}
+	return counter
+}
+
+func TestPNCounterMergeLaws(t *testing.T) {
+	merged := func(a *types.PNCounter, b *types.PNCounter) *types.PNCounter {
+		m := a.Copy()
+		m.Merge(b)
+		return m
+	}
+	commutative := func(x, y []counterOp) bool {
+		a, b := replicaOf(x), replicaOf(y)
+		return merged(a, b).Equal(merged(b, a))
+	}
+	associative := func(x, y, z []counterOp) bool {
+		a, b, c := replicaOf(x), replicaOf(y), replicaOf(z)
+		return merged(merged(a, b), c).Equal(merged(a, merged(b, c)))
+	}
+	idempotent := func(x []counterOp) bool {
+		a := replicaOf(x)
+		return merged(a, a).Equal(a)
+	}
+	for _, property := range []interface{}{commutative, associative, idempotent} {
+		if err := quick.Check(property, nil); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestPNCounterConvergence - every replica sends its own entry after each of its updates, as SyncedMemory does.
+// The messages reach the other replicas late, out of order, twice or not at all, and a last round of
+// snapshots stands in for the ones the gaps ask for. The replicas end up the same, with the true count
+func TestPNCounterConvergence(t *testing.T) {
+	type message struct {
+		to         int
+		node       string
+		incr, decr int
+	}
+	converges := func(ops []counterOp, seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		replicas := make([]*types.PNCounter, counterReplicas)
+		for i := range replicas {
+			replicas[i] = types.NewPNCounter()
+		}
+		pending := []message{}
+		send := func(from int) {
+			node := fmt.Sprintf("n%d", from)
+			incr, decr := replicas[from].Entry(node)
+			for to := range replicas {
+				for copies := rng.Intn(3); to != from && copies > 0; copies-- {
+					pending = append(pending, message{to: to, node: node, incr: incr, decr: decr})
+				}
+			}
+		}
+		deliver := func(count int) {
+			rng.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+			for ; count > 0 && len(pending) > 0; count-- {
+				msg := pending[0]
+				pending = pending[1:]
+				replicas[msg.to].MergeEntry(msg.node, msg.incr, msg.decr)
+			}
+		}
+		total := 0
+		for _, op := range ops {
+			from := int(op.Node % counterReplicas)
+			total += applyCounterOp(replicas[from], fmt.Sprintf("n%d", from), op)
+			send(from)
+			deliver(rng.Intn(len(pending) + 1))
+		}
+		for from := range replicas {
+			node := fmt.Sprintf("n%d", from)
+			incr, decr := replicas[from].Entry(node)
+			for to := range replicas {
+				pending = append(pending, message{to: to, node: node, incr: incr, decr: decr})
+			}
+		}
+		deliver(len(pending))
+		for _, replica := range replicas {
+			if !replica.Equal(replicas[0]) || replica.Value() != total {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(converges, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+// shufflingTransport - hands every message to the other nodes out of order, some of them twice,
+// and some only with a later read. Unless ordered, which hands them over once and in order. A node
+// only gets the messages published after it connected
+type shufflingTransport struct {
+	node    int
+	inboxes [][][]byte
+	rng     *rand.Rand
+	ordered bool
+	lock    *sync.Mutex
+}
+
+func newShufflingTransports(nodes int) []cache.Transport {
+	return newTestTransports(nodes, false)
+}
+
+func newOrderedTransports(nodes int) []cache.Transport {
+	return newTestTransports(nodes, true)
+}
+
+func newTestTransports(nodes int, ordered bool) []cache.Transport {
+	inboxes := make([][][]byte, nodes)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	lock := &sync.Mutex{}
+	transports := []cache.Transport{}
+	for n := 0; n < nodes; n++ {
+		transports = append(transports, &shufflingTransport{node: n, inboxes: inboxes, rng: rng, ordered: ordered, lock: lock})
+	}
+	return transports
+}
+
+func (s *shufflingTransport) Connect(replay time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inboxes[s.node] = nil
+	return nil
+}
+
+func (s *shufflingTransport) Publish(payloads [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for to := range s.inboxes {
+		for _, payload := range payloads {
+			copies := 1
+			if !s.ordered {
+				copies += s.rng.Intn(2)
+			}
+			for ; to != s.node && copies > 0; copies-- {
+				s.inboxes[to] = append(s.inboxes[to], payload)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *shufflingTransport) Receive(timeout time.Duration) ([]cache.Received, error) {
+	if timeout > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	inbox := s.inboxes[s.node]
+	if !s.ordered {
+		s.rng.Shuffle(len(inbox), func(i, j int) { inbox[i], inbox[j] = inbox[j], inbox[i] })
+	}
+	received := []cache.Received{}
+	kept := [][]byte{}
+	for _, payload := range inbox {
+		if !s.ordered && s.rng.Intn(3) == 0 {
+			kept = append(kept, payload)
+			continue
+		}
+		received = append(received, cache.Received{Payload: payload, SentAt: time.Now()})
+	}
+	s.inboxes[s.node] = kept
+	return received, nil
+}
+
+func (s *shufflingTransport) Close() error { return nil }
+
+func TestSyncedMemoryConvergesOverUnorderedTransport(t *testing.T) {
+	transports := newShufflingTransports(3)
+	nodes := []*cache.SyncedMemory{}
+	for n, transport := range transports {
+		config := &cache.SyncMemoryConfig{MaxTTL: time.Minute, FlushInterval: time.Second, NodeID: fmt.Sprintf("n%d", n), Transport: transport}
+		nodes = append(nodes, cache.NewSyncedMemory(config, nil))
+	}
+	own := make([]int, len(nodes))
+	total := 0
+	for round := 0; round < 3; round++ {
+		for n, sm := range nodes {
+			for i := 0; i <= n; i++ {
+				sm.IncrByAndGet("key", 2)
+			}
+			sm.DecrByAndGet("key", 1)
+			own[n] += 2*(n+1) - 1
+			total += 2*(n+1) - 1
+		}
+		time.Sleep(700 * time.Millisecond)
+	}
+	time.Sleep(4 * time.Second)
+	for n, sm := range nodes {
+		isEqual(total-own[n], sm.GetGlobalCount("key"), t)
+		sm.Close()
+	}
+}
+
+// replayTransport - keeps what is published, and hands out the batches it was given as the replay of the stream.
+// With a clock, every batch takes step to read
+type replayTransport struct {
+	batches   [][]cache.Received
+	published [][]byte
+	clock     *clock.FakeClock
+	step      time.Duration
+	lock      sync.Mutex
+}
+
+func (r *replayTransport) Connect(replay time.Duration) error { return nil }
+
+func (r *replayTransport) Publish(payloads [][]byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.published = append(r.published, payloads...)
+	return nil
+}
+
+func (r *replayTransport) Receive(timeout time.Duration) ([]cache.Received, error) {
+	r.lock.Lock()
+	if len(r.batches) == 0 {
+		r.lock.Unlock()
+		if timeout > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil, nil
+	}
+	batch := r.batches[0]
+	r.batches = r.batches[1:]
+	r.lock.Unlock()
+	if r.clock != nil {
+		r.clock.Advance(r.step)
+	}
+	return batch, nil
+}
+
+func (r *replayTransport) Close() error { return nil }
+
+func (r *replayTransport) taken() [][]byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([][]byte{}, r.published...)
+}
+
+// lockedBuffer - a log destination the nodes' goroutines write to while the test reads it
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestIdlePeerAnswersSnapshotRequest(t *testing.T) {
+	transports := newOrderedTransports(2)
+	idle := cache.NewSyncedMemory(&cache.SyncMemoryConfig{MaxTTL: time.Second, FlushInterval: time.Second, NodeID: "idle", Transport: transports[0]}, nil)
+	defer idle.Close()
+	idle.IncrByAndGet("key", 1)
+	// the count goes out and expires, leaving the node past its first message with nothing to send
+	time.Sleep(3 * time.Second)
+
+	var buf lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	joiner := cache.NewSyncedMemory(&cache.SyncMemoryConfig{MaxTTL: time.Second, FlushInterval: time.Second, NodeID: "joiner", Transport: transports[1], Logger: logger}, nil)
+	time.Sleep(5 * time.Second)
+	joiner.Close()
+	// the empty snapshot carries the sequence number, one request is enough
+	requests := strings.Count(buf.String(), "missed messages, requesting a snapshot")
+	if requests < 1 || requests > 2 {
+		t.Fatalf("Expected the joiner to ask the idle peer for a snapshot once, it asked %d times", requests)
+	}
+	isEqual(1, len(joiner.Peers()), t)
+}
+
+// messagesOf - the messages of a node counting 5 for key, then idling: the count, then the heartbeats that followed it
+func messagesOf(t *testing.T, node string) [][]byte {
+	source := &replayTransport{}
+	peer := cache.NewSyncedMemory(&cache.SyncMemoryConfig{MaxTTL: time.Minute, FlushInterval: time.Second, NodeID: node, Transport: source}, nil)
+	peer.IncrByAndGet("key", 5)
+	time.Sleep(2500 * time.Millisecond)
+	peer.Close()
+	published := source.taken()
+	if len(published) < 2 {
+		t.Fatalf("Expected %s to flush its count and a heartbeat, got %d messages", node, len(published))
+	}
+	return published
+}
+
+func TestReplaySpanningSeveralBatches(t *testing.T) {
+	peer := messagesOf(t, "peer")
+	ours := messagesOf(t, "joiner")
+	// one message per read, and slow reads: the peer's count, messages of an earlier run of ours
+	// that take the replay past the peer timeout, then the peer's heartbeat
+	clk := clock.NewFakeClock(time.Now())
+	replay := &replayTransport{clock: clk, step: 2 * time.Second}
+	for _, payload := range append(append([][]byte{peer[0]}, ours...), peer[1]) {
+		replay.batches = append(replay.batches, []cache.Received{{Payload: payload, SentAt: time.Now(), Replayed: true}})
+	}
+	joiner := cache.NewSyncedMemory(&cache.SyncMemoryConfig{MaxTTL: time.Minute, FlushInterval: time.Second, NodeID: "joiner", Transport: replay, Clock: clk}, nil)
+	defer joiner.Close()
+	isEqual(5, joiner.GetGlobalCount("key"), t)
+	isEqual(1, len(joiner.Peers()), t)
+}
+
+// lagCollector - keeps the lag of the reads that brought messages
+type lagCollector struct {
+	metrics.Nop
+	lags []time.Duration
+	lock sync.Mutex
+}
+
+func (c *lagCollector) ObserveStreamRead(duration time.Duration, lag time.Duration, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if lag > 0 {
+		c.lags = append(c.lags, lag)
+	}
+}
+
+func TestReaderFallingBehind(t *testing.T) {
+	published := messagesOf(t, "peer")
+	// MaxLag defaults to 2 FlushIntervals: a read 1.5s behind is fine, 10s behind is not
+	now := time.Now()
+	behind := &replayTransport{}
+	for i, age := range []time.Duration{1500 * time.Millisecond, 10 * time.Second, 10 * time.Second, 10 * time.Second, 0, 0} {
+		behind.batches = append(behind.batches, []cache.Received{{Payload: published[i%len(published)], SentAt: now.Add(-age)}})
+	}
+	var buf lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	collector := &lagCollector{}
+	config := &cache.SyncMemoryConfig{MaxTTL: time.Minute, FlushInterval: time.Second, NodeID: "reader", Transport: behind,
+		BootstrapTimeout: -1, Logger: logger, Metrics: collector}
+	reader := cache.NewSyncedMemory(config, nil)
+	time.Sleep(500 * time.Millisecond)
+	reader.Close()
+
+	warnings, recoveries := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		isEqual(nil, json.Unmarshal([]byte(line), &record), t)
+		msg := record["msg"].(string)
+		if strings.HasPrefix(msg, "sync reader is falling behind") {
+			warnings++
+			// by the read 10s behind, not the one within MaxLag
+			isEqual(true, record["lag"].(float64) >= float64(10*time.Second), t)
+		} else if msg == "sync reader has caught up" {
+			recoveries++
+		}
+	}
+	isEqual(1, warnings, t)
+	isEqual(1, recoveries, t)
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	isEqual(6, len(collector.lags), t)
+	isEqual(true, collector.lags[0] < 2*time.Second && collector.lags[1] >= 10*time.Second, t)
+	isEqual(true, collector.lags[5] < time.Second, t)
+}
+
+func TestPeerWithSkewedClock(t *testing.T) {
+	published := messagesOf(t, "peer")
+	// the peer's clock is an hour behind
+	skewed := &replayTransport{}
+	for _, payload := range published {
+		skewed.batches = append(skewed.batches, []cache.Received{{Payload: payload, SentAt: time.Now().Add(-time.Hour)}})
+	}
+	joiner := cache.NewSyncedMemory(&cache.SyncMemoryConfig{MaxTTL: time.Minute, FlushInterval: time.Second, NodeID: "joiner", Transport: skewed}, nil)
+	defer joiner.Close()
+	time.Sleep(time.Second)
+	peers := joiner.Peers()
+	isEqual(1, len(peers), t)
+	isEqual(true, time.Since(peers[0].LastSeen) < 2*time.Second, t)
+	isEqual(5, joiner.GetGlobalCount("key"), t)
+}
+
+func TestClientRuleOverrides(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 10, interval: 10}}
+	clrules := []ClientRule{
+		// premium client: bigger bursts refilling at the same 1 unit per second
+		{id: "premium", clientId: "dp1", quota: 10, overridenCommonRuleId: "cr1", algorithm: ALGO_TOKEN_BUCKET, burst: 20},
+		// a client with a longer window
+		{id: "slow", clientId: "dp2", quota: 10, overridenCommonRuleId: "cr1", interval: 60},
+	}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, clrules, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	premium := Event{resourceId: "api/call1", clientId: "dp1"}
+	slow := Event{resourceId: "api/call1", clientId: "dp2"}
+
+	res := limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1", cost: 20})
+	isEqual(false, res.hasBreached, t)
+	res = limiter.RecordEventAndCheck(premium)
+	isEqual(true, res.hasBreached, t)
+	isEqual("premium", res.breachedRuleId, t)
+
+	for i := 0; i < 10; i++ {
+		limiter.RecordEventAndCheck(slow)
+	}
+	clk.Advance(10 * time.Second)
+	// the common rule would have reset by now, the override hasn't
+	res = limiter.RecordEventAndCheck(slow)
+	isEqual(true, res.hasBreached, t)
+	isEqual("slow", res.breachedRuleId, t)
+}
+
+func TestSustainedOverload(t *testing.T) {
+	// twice the quota, for six intervals
+	allowed := func(algorithm Algorithm, burst int) int {
+		cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 10, interval: 10, algorithm: algorithm, burst: burst}}
+		clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+		limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+		count := 0
+		for i := 0; i < 120; i++ {
+			if !limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"}).hasBreached {
+				count++
+			}
+			clk.Advance(500 * time.Millisecond)
+		}
+		return count
+	}
+	// rejected events don't count against the next window, the long run rate is the quota
+	for _, count := range []int{allowed(ALGO_FIXED_WINDOW, 0), allowed(ALGO_SLIDING_WINDOW, 0), allowed(ALGO_TOKEN_BUCKET, 10)} {
+		if count < 55 || count > 60 {
+			t.Fatalf("Expected about 60 events allowed in 60 seconds, got %d", count)
+		}
+	}
+}
+
+func TestTokenBucketWithSmallBurst(t *testing.T) {
+	// refills a unit every 10ms, holding 10 at most
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 100, interval: 1, algorithm: ALGO_TOKEN_BUCKET, burst: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	allowed := 0
+	for i := 0; i < 1000; i++ {
+		if !limiter.RecordEventAndCheck(inst).hasBreached {
+			allowed++
+		}
+		clk.Advance(10 * time.Millisecond)
+	}
+	if allowed < 950 {
+		t.Fatalf("Expected about 1000 events allowed at the refill rate, got %d", allowed)
+	}
+	// a burst only gets what the bucket holds
+	clk.Advance(time.Second)
+	allowed = 0
+	for i := 0; i < 50; i++ {
+		if !limiter.RecordEventAndCheck(inst).hasBreached {
+			allowed++
+		}
+	}
+	isEqual(10, allowed, t)
+}
+
+func TestValidateRules(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "cr1", resourceId: "api/call1", quota: 10, interval: 10},
+		{id: "global", resourceId: "api/call1", quota: 100, interval: 10, scope: SCOPE_GLOBAL},
+	}
+	isEqual(nil, ValidateRules(cmrules, []ClientRule{{id: "cl1", clientId: "dp1", quota: 5, overridenCommonRuleId: "cr1", interval: 30}}), t)
+	invalid := [][]ClientRule{
+		{{id: "cl1", clientId: "dp1", quota: 5, overridenCommonRuleId: "missing"}},
+		{{id: "cl1", clientId: "dp1", quota: 5, overridenCommonRuleId: "global"}},
+		{{id: "cl1", clientId: "dp1", quota: 5, overridenCommonRuleId: "cr1", interval: -1}},
+		{{id: "cl1", clientId: "dp1", quota: 5, overridenCommonRuleId: "cr1", algorithm: ALGO_TOKEN_BUCKET}},
+	}
+	for _, clrules := range invalid {
+		if ValidateRules(cmrules, clrules) == nil {
+			t.Fatalf("Expected %+v to be rejected", clrules)
+		}
+	}
+}
+
+func TestRuleUpdatesKeepIndexConsistent(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 2, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	other := Event{resourceId: "api/call1", clientId: "dp2"}
+
+	isEqual(nil, limiter.AddClientRules([]ClientRule{{id: "cl1", clientId: "dp1", quota: 1, overridenCommonRuleId: "cr1"}}), t)
+	limiter.RecordEventAndCheck(inst)
+	isEqual("cl1", limiter.RecordEventAndCheck(inst).breachedRuleId, t)
+	// overrides only apply to their own client
+	limiter.RecordEventAndCheck(other)
+	isEqual(false, limiter.RecordEventAndCheck(other).hasBreached, t)
+
+	// replacing the override takes the old one out of the index
+	isEqual(nil, limiter.AddClientRules([]ClientRule{{id: "cl1", clientId: "dp1", quota: 10, overridenCommonRuleId: "cr1"}}), t)
+	isEqual(false, limiter.RecordEventAndCheck(inst).hasBreached, t)
+
+	// moving the common rule to another resource moves its overrides along
+	isEqual(nil, limiter.AddCommonRules([]CommonRule{{id: "cr1", resourceId: "api/call2", quota: 2, interval: 10}}), t)
+	isEqual(0, len(limiter.findLimits(inst)), t)
+	isEqual("cl1", limiter.findLimits(Event{resourceId: "api/call2", clientId: "dp1"})[0].ruleId, t)
+
+	limiter.RemoveClientRules("cl1")
+	isEqual("cr1", limiter.findLimits(Event{resourceId: "api/call2", clientId: "dp1"})[0].ruleId, t)
+
+	if limiter.AddClientRules([]ClientRule{{id: "cl2", clientId: "dp1", quota: 1, overridenCommonRuleId: "missing"}}) == nil {
+		t.Fatalf("Expected an override of a missing rule to be rejected")
+	}
+	limiter.RemoveCommonRules("cr1")
+	isEqual(0, len(limiter.findLimits(Event{resourceId: "api/call2", clientId: "dp1"})), t)
+
+	// common rules can't change under their overrides into something the overrides don't work with
+	isEqual(nil, limiter.AddCommonRules([]CommonRule{{id: "cr3", resourceId: "api/call3", quota: 2, interval: 10}}), t)
+	isEqual(nil, limiter.AddClientRules([]ClientRule{{id: "blocked", clientId: "dp1", quota: 0, overridenCommonRuleId: "cr3"}}), t)
+	for _, update := range []CommonRule{
+		{id: "cr3", resourceId: "api/call3", quota: 2, interval: 10, algorithm: ALGO_TOKEN_BUCKET, burst: 5},
+		{id: "cr3", resourceId: "api/call3", quota: 2, interval: 10, scope: SCOPE_GLOBAL},
+	} {
+		if limiter.AddCommonRules([]CommonRule{update}) == nil {
+			t.Fatalf("Expected %+v to be rejected, as it invalidates an override", update)
+		}
+	}
+	isEqual("blocked", limiter.RecordEventAndCheck(Event{resourceId: "api/call3", clientId: "dp1"}).breachedRuleId, t)
+	// a rule that slipped through never takes the request path down
+	isEqual(0, CommonRule{id: "bad", quota: 0, interval: 10, algorithm: ALGO_TOKEN_BUCKET, burst: 5}.toLimit(Event{}).quota, t)
+}
+
+func TestShadowRules(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "enforced", resourceId: "api/call1", quota: 3, interval: 10},
+		{id: "candidate", resourceId: "api/call1", quota: 1, interval: 10, scope: SCOPE_GLOBAL, mode: MODE_SHADOW},
+	}
+	// trying out a stricter quota for dp1
+	clrules := []ClientRule{{id: "stricter", clientId: "dp1", quota: 2, overridenCommonRuleId: "enforced", mode: MODE_SHADOW}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, clrules, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	shadowBreaches := []notify.Notification{}
+	limiter.OnShadowBreach(func(n notify.Notification) { shadowBreaches = append(shadowBreaches, n) })
+
+	res := limiter.RecordEventAndCheck(inst)
+	isEqual(false, res.hasBreached, t)
+	isEqual(0, len(res.shadowBreaches), t)
+
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(false, res.hasBreached, t)
+	isEqual(1, len(res.shadowBreaches), t)
+	isEqual("candidate", res.shadowBreaches[0], t)
+	isEqual(1, len(shadowBreaches), t)
+	isEqual(notify.SHADOW_BREACH, shadowBreaches[0].Kind, t)
+
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(false, res.hasBreached, t)
+	isEqual(2, len(res.shadowBreaches), t)
+
+	// the enforced common rule still applies to dp1 alongside its shadow override
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(true, res.hasBreached, t)
+	isEqual("enforced", res.breachedRuleId, t)
+}
+
+func TestHooksRegisteringHooks(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 1, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk})
+	breaches := 0
+	// the first breach adds a hook for the next ones
+	limiter.OnBreach(func(n notify.Notification) {
+		if breaches == 0 {
+			limiter.OnBreach(func(n notify.Notification) { breaches++ })
+		}
+		breaches++
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a hook to be able to register another one")
+	}
+	// one breach for the first hook alone, then one for both
+	isEqual(3, breaches, t)
+}
+
+func TestPenaltyBox(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 1, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	penalty := &PenaltyConfig{Breaches: 2, Within: 60 * time.Second, BanDuration: 30 * time.Second, MaxBanDuration: 45 * time.Second}
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Penalty: penalty})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+
+	limiter.RecordEventAndCheck(inst)
+	isEqual(false, limiter.RecordEventAndCheck(inst).banned, t)
+	res := limiter.RecordEventAndCheck(inst)
+	isEqual(true, res.banned, t)
+	isEqual(clk.Now().Add(30*time.Second), res.bannedUntil, t)
+
+	// the window has rolled over, but the ban holds
+	clk.Advance(20 * time.Second)
+	isEqual(true, limiter.RecordEventAndCheck(inst).banned, t)
+	isEqual(false, limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2"}).hasBreached, t)
+	bans := limiter.ListBans()
+	isEqual(1, len(bans), t)
+	isEqual("dp1", bans[0].clientId, t)
+
+	clk.Advance(10 * time.Second)
+	isEqual(false, limiter.RecordEventAndCheck(inst).hasBreached, t)
+
+	// the breaches before the ban don't count again: one more is not enough for another ban
+	isEqual(false, limiter.RecordEventAndCheck(inst).banned, t)
+	// a repeat offence gets a longer ban, up to the cap
+	res = limiter.RecordEventAndCheck(inst)
+	isEqual(true, res.banned, t)
+	isEqual(clk.Now().Add(45*time.Second), res.bannedUntil, t)
+
+	limiter.LiftBan("dp1")
+	isEqual(0, len(limiter.ListBans()), t)
+	clk.Advance(10 * time.Second)
+	isEqual(false, limiter.RecordEventAndCheck(inst).hasBreached, t)
+}
+
+func TestPenaltyBoxSlidingWindow(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 1, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	penalty := &PenaltyConfig{Breaches: 3, Within: 60 * time.Second, BanDuration: 30 * time.Second}
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Penalty: penalty})
+	breach := func(at time.Duration) Result {
+		clk.Set(time.Unix(1553681100, 0).Add(at))
+		// over the quota on its own
+		return limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1", cost: 2})
+	}
+	// two breaches either side of a window boundary: four within seven seconds is more than enough
+	isEqual(false, breach(45*time.Second).banned, t)
+	isEqual(false, breach(58*time.Second).banned, t)
+	isEqual(false, breach(61*time.Second).banned, t)
+	isEqual(true, breach(62*time.Second).banned, t)
+
+	// breaches are counted over at most the lifetime of the counters
+	isEqual(nil, (&PenaltyConfig{Breaches: 3, Within: 5 * time.Minute, BanDuration: time.Minute}).validate(), t)
+	isEqual(true, (&PenaltyConfig{Breaches: 3, Within: time.Hour, BanDuration: time.Minute}).validate() != nil, t)
+	// without a cap, the escalation stops well before overflowing
+	uncapped := &PenaltyConfig{Breaches: 3, Within: time.Minute, BanDuration: time.Minute}
+	isEqual(4*time.Minute, uncapped.banDuration(3), t)
+	isEqual(penaltyMaxBanDuration, uncapped.banDuration(100), t)
+}
+
+func TestAccessRules(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 1, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	access := []AccessRule{
+		{id: "health", access: ACCESS_ALLOW, clientId: "healthcheck"},
+		{id: "partner", access: ACCESS_ALLOW, cidr: "10.1.0.0/16", expiresAt: clk.Now().Add(time.Minute)},
+		{id: "abuser", access: ACCESS_DENY, cidr: "2001:db8::/32"},
+		{id: "bad-host", access: ACCESS_DENY, cidr: "10.1.2.3/32"},
+	}
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Access: access})
+	partner := Event{resourceId: "api/call1", clientId: "dp1", labels: map[string]string{IP_LABEL: "10.1.7.7"}}
+
+	for i := 0; i < 5; i++ {
+		res := limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "healthcheck"})
+		isEqual(false, res.hasBreached, t)
+		isEqual(true, res.allowlisted, t)
+		isEqual(false, limiter.RecordEventAndCheck(partner).hasBreached, t)
+	}
+
+	// denies win over the partner range
+	res := limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp1", labels: map[string]string{IP_LABEL: "10.1.2.3"}})
+	isEqual(true, res.denylisted, t)
+	isEqual("bad-host", res.accessRuleId, t)
+	res = limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "dp2", labels: map[string]string{IP_LABEL: "2001:db8::1"}})
+	isEqual(true, res.denylisted, t)
+
+	// once the partner rule expires, dp1 is limited again
+	clk.Advance(time.Minute)
+	isEqual(false, limiter.RecordEventAndCheck(partner).hasBreached, t)
+	isEqual(true, limiter.RecordEventAndCheck(partner).hasBreached, t)
+
+	if limiter.AddAccessRules([]AccessRule{{id: "broken", cidr: "10.0.0.0/99"}}) == nil {
+		t.Fatalf("Expected an invalid cidr to be rejected")
+	}
+	limiter.RemoveAccessRules("health")
+	limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "healthcheck"})
+	isEqual(true, limiter.RecordEventAndCheck(Event{resourceId: "api/call1", clientId: "healthcheck"}).hasBreached, t)
+}
+
+// recordingCollector - keeps the decisions and store operations reported to it
+type recordingCollector struct {
+	metrics.Nop
+	decisions  map[string]int
+	operations map[string]int
+}
+
+func (c *recordingCollector) ObserveDecision(ruleId string, decision metrics.Decision) {
+	c.decisions[ruleId+"/"+string(decision)]++
+}
+
+func (c *recordingCollector) ObserveStoreOperation(store string, operation string, duration time.Duration) {
+	c.operations[store+"/"+operation]++
+}
+
+// streamCollector - keeps the last stream length reported to it
+type streamCollector struct {
+	metrics.Nop
+	length int64
+	lock   sync.Mutex
+}
+
+func (c *streamCollector) SetStreamLength(stream string, length int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.length = length
+}
+
+func TestStreamRetention(t *testing.T) {
+	server := miniredis.RunT(t)
+	port, _ := strconv.Atoi(server.Port())
+	streamID := func(at time.Time) string { return fmt.Sprintf("%d-0", at.UnixNano()/int64(time.Millisecond)) }
+	// entries of an hour ago and more, with a retention of an hour
+	server.XAdd("retention:go-throttler", streamID(time.Now().Add(-2*time.Hour)), []string{"m", "expired"})
+	server.XAdd("retention:go-throttler", streamID(time.Now().Add(-30*time.Minute)), []string{"m", "retained"})
+	collector := &streamCollector{}
+	config := &cache.SyncMemoryConfig{MaxTTL: time.Hour, FlushInterval: time.Second, Namespace: "retention", BootstrapTimeout: -1, Metrics: collector}
+	sm := cache.NewSyncedMemory(config, &cache.RedisConfig{Host: server.Host(), Port: port})
+	sm.IncrByAndGet("key", 1)
+	time.Sleep(1500 * time.Millisecond)
+	sm.Close()
+
+	entries, err := server.Stream("retention:go-throttler")
+	isEqual(nil, err, t)
+	values := []string{}
+	for _, entry := range entries {
+		values = append(values, entry.Values...)
+	}
+	isEqual(false, strings.Contains(strings.Join(values, " "), "expired"), t)
+	isEqual(true, strings.Contains(strings.Join(values, " "), "retained"), t)
+	// the one retained, the ping of the node joining, and its flushes
+	isEqual(true, len(entries) >= 3, t)
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	isEqual(int64(len(entries)), collector.length, t)
+}
+
+func TestStreamRetentionBeforeRedis62(t *testing.T) {
+	redis61 := miniredis.RunT(t)
+	port, _ := strconv.Atoi(redis61.Port())
+	trims := make(chan string, 16)
+	redis61.Server().SetPreHook(func(peer *server.Peer, cmd string, args ...string) bool {
+		if strings.ToUpper(cmd) != "XTRIM" {
+			return false
+		}
+		select {
+		case trims <- strings.ToUpper(args[1]):
+		default:
+		}
+		if strings.ToUpper(args[1]) == "MINID" {
+			peer.WriteError("ERR syntax error")
+			return true
+		}
+		return false
+	})
+	config := &cache.SyncMemoryConfig{MaxTTL: time.Hour, FlushInterval: time.Second, Namespace: "retention", BootstrapTimeout: -1}
+	sm := cache.NewSyncedMemory(config, &cache.RedisConfig{Host: redis61.Host(), Port: port})
+	sm.IncrByAndGet("key", 1)
+	time.Sleep(2500 * time.Millisecond)
+	sm.Close()
+	// the flushes went through, and trim by length once trimming by id was rejected
+	isEqual(cache.SYNC_HEALTHY, sm.Health().State, t)
+	isEqual("MINID", <-trims, t)
+	isEqual("MAXLEN", <-trims, t)
+	entries, _ := redis61.Stream("retention:go-throttler")
+	isEqual(true, len(entries) >= 3, t)
+}
+
+func TestMetrics(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "cr1", resourceId: "api/call1", quota: 2, interval: 10},
+		{id: "candidate", resourceId: "api/call1", quota: 1, interval: 10, mode: MODE_SHADOW},
+	}
+	collector := &recordingCollector{decisions: make(map[string]int), operations: make(map[string]int)}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Metrics: collector})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	for i := 0; i < 3; i++ {
+		limiter.RecordEventAndCheck(inst)
+	}
+	isEqual(2, collector.decisions["cr1/allowed"], t)
+	isEqual(1, collector.decisions["cr1/throttled"], t)
+	isEqual(1, collector.decisions["candidate/allowed"], t)
+	isEqual(1, collector.decisions["candidate/shadow_throttled"], t)
+	isEqual(5, collector.operations["memory/incr"], t)
+}
+
 func isEqual(expected interface{}, actual interface{}, t *testing.T) {
 	if expected == actual {
 		// all good
@@ -159,6 +1355,95 @@ func isEqual(expected interface{}, actual interface{}, t *testing.T) {
 		t.Fatalf("Expected %v but go %v", expected, actual)
 	}
 }
+
+func TestBreachHooks(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 4, interval: 10}}
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	penalty := &PenaltyConfig{Breaches: 2, Within: 60 * time.Second, BanDuration: 30 * time.Second}
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Penalty: penalty})
+	var buf bytes.Buffer
+	sink := notify.NewAsyncSink(notify.NewJSONLSink(&buf), notify.AsyncConfig{BufferSize: 8})
+	kinds := []notify.Kind{}
+	record := func(n notify.Notification) { kinds = append(kinds, n.Kind) }
+	limiter.OnBreach(record)
+	limiter.OnBanned(record)
+	limiter.OnBanned(sink.Notify)
+	isEqual(true, limiter.OnNearLimit(0, record) != nil, t)
+	isEqual(nil, limiter.OnNearLimit(75, record), t)
+
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	for i := 0; i < 6; i++ {
+		limiter.RecordEventAndCheck(inst)
+	}
+	// 3 of 4 is near the limit, then the 5th and 6th events breach it, the second breach banning the client
+	isEqual(4, len(kinds), t)
+	isEqual(notify.NEAR_LIMIT, kinds[0], t)
+	isEqual(notify.BREACH, kinds[1], t)
+	isEqual(notify.BREACH, kinds[2], t)
+	isEqual(notify.BANNED, kinds[3], t)
+
+	sink.Close()
+	isEqual(true, strings.Contains(buf.String(), `"kind":"banned","rule_id":"cr1","scope":"client","subject":"dp1"`), t)
+	isEqual(1, strings.Count(buf.String(), "\n"), t)
+	sink.Notify(notify.Notification{Kind: notify.BREACH})
+	isEqual(int64(1), sink.Dropped(), t)
+}
+
+func TestStructuredLogging(t *testing.T) {
+	cmrules := []CommonRule{
+		{id: "cr1", resourceId: "api/call1", quota: 5, interval: 10},
+		{id: "candidate", resourceId: "api/call1", quota: 1, interval: 10, mode: MODE_SHADOW},
+	}
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	record := func(level slog.Level) string {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+		clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+		limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Logger: logger})
+		limiter.RecordEventAndCheck(inst)
+		limiter.RecordEventAndCheck(inst)
+		return buf.String()
+	}
+	// shadow breaches are per event, and left to the metrics and hooks at info level
+	isEqual("", record(slog.LevelInfo), t)
+	logs := record(slog.LevelDebug)
+	isEqual(true, strings.Contains(logs, `"msg":"shadow rule breached","rule_id":"candidate"`), t)
+	isEqual(true, strings.Contains(logs, `"subject":"dp1"`), t)
+}
+
+func TestTracing(t *testing.T) {
+	cmrules := []CommonRule{{id: "cr1", resourceId: "api/call1", quota: 1, interval: 10}}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	limiter := NewApiRateLimiterWithConfig(cmrules, []ClientRule{}, &LimiterConfig{StoreType: STORE_MEMORY, Clock: clk, Tracer: otel.NewTracer(provider)})
+	inst := Event{resourceId: "api/call1", clientId: "dp1"}
+	limiter.RecordEventAndCheck(inst)
+	limiter.RecordEventAndCheck(inst)
+
+	spans := exporter.GetSpans()
+	decisions := 0
+	for _, span := range spans {
+		if span.Name != "gatekeeper.RecordEventAndCheck" {
+			continue
+		}
+		decisions++
+		for _, child := range spans {
+			if child.Parent.SpanID() == span.SpanContext.SpanID() {
+				isEqual("store.incr", child.Name, t)
+			}
+		}
+	}
+	isEqual(2, decisions, t)
+	last := spans[len(spans)-1]
+	isEqual("gatekeeper.RecordEventAndCheck", last.Name, t)
+	for _, attr := range last.Attributes {
+		if attr.Key == "breached" {
+			isEqual(true, attr.Value.AsBool(), t)
+		}
+	}
+}
+
 func TestSyncMemoryStrategy(t *testing.T) {
 	rule1 := CommonRule{id: "cr1", resourceId: "api/call1", quota: 20, interval: 60}
 	cmrules := []CommonRule{rule1}
@@ -203,16 +1488,28 @@ func TestSyncMemoryStrategy(t *testing.T) {
 
 var logger *log.Logger
 
+func TestSyncedMemoryWithoutRedis(t *testing.T) {
+	config := &cache.SyncMemoryConfig{MaxTTL: 10 * time.Second, FlushInterval: time.Second, NodeID: "H1"}
+	sm := cache.NewSyncedMemory(config, &cache.RedisConfig{Host: "127.0.0.1", Port: 1})
+	health := sm.Health()
+	isEqual(cache.SYNC_CONNECTING, health.State, t)
+	isEqual(true, health.LastError != nil, t)
+	// counting carries on, with local counts only
+	sm.IncrAndGet("key")
+	isEqual(2, sm.IncrAndGet("key"), t)
+}
+
 func TestCacheCleanup(t *testing.T) {
-	var c = cache.NewCache(time.Duration(30 * time.Second))
+	clk := clock.NewFakeClock(time.Unix(1553681100, 0))
+	var c = cache.NewCacheWithConfig(time.Duration(30*time.Second), cache.CacheConfig{Clock: clk})
 	key := "test_key"
 	for i := 0; i < 10; i++ {
 		c.IncrAndGet(key)
 	}
 	fmt.Println("Current Value is: ", c.IncrAndGet(key))
-	fmt.Println(time.Now())
-	fmt.Println("Sleeping for 20 seconds")
-	time.Sleep(20 * time.Second)
+	fmt.Println(clk.Now())
+	fmt.Println("Advancing the clock by 20 seconds")
+	clk.Advance(20 * time.Second)
 	var expectedResult = 12
 	var actualResult = c.IncrAndGet(key)
 	fmt.Println("Value is: ", actualResult)
@@ -220,8 +1517,8 @@ func TestCacheCleanup(t *testing.T) {
 		t.Fatalf("Expected %d but got %d", expectedResult, actualResult)
 	}
 
-	fmt.Println("Sleeping for 40 seconds")
-	time.Sleep(40 * time.Second)
+	fmt.Println("Advancing the clock by 40 seconds")
+	clk.Advance(40 * time.Second)
 
 	expectedResult = 1
 	actualResult = c.IncrAndGet(key)
@@ -0,0 +1,92 @@
+package gatekeeper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Reservation - units held against the limits of an event whose true cost is only known later.
+// Obtained from ApiRateLimiter.Reserve and settled exactly once with Commit or Cancel.
+type Reservation struct {
+	limiter   *ApiRateLimiter
+	inst      Event
+	estimated int
+	counters  []trackedCounter
+	settled   bool
+	mu        sync.Mutex
+}
+
+// Reserve - records the event with its estimated cost, the same way RecordEventAndCheck does.
+// A reservation is returned even when the event breaches, as the estimate has been counted either way;
+// callers that reject the event should Cancel it to give the units back.
+func (r *ApiRateLimiter) Reserve(inst Event, estimatedCost int) (*Reservation, Result) {
+	return r.ReserveContext(context.Background(), inst, estimatedCost)
+}
+
+// ReserveContext - same as Reserve, tracing under the given context
+func (r *ApiRateLimiter) ReserveContext(ctx context.Context, inst Event, estimatedCost int) (*Reservation, Result) {
+	inst.cost = estimatedCost
+	estimatedCost = inst.weight()
+	res, counters := r.recordEvent(ctx, "Reserve", inst)
+	return &Reservation{limiter: r, inst: inst, estimated: estimatedCost, counters: counters}, res
+}
+
+// Commit - replaces the estimate with the actual cost. The difference is applied to the windows the
+// reservation was made in. When such a window has already closed, a refund has nothing left to protect
+// and is dropped, while an overrun is charged to the rule's current window instead.
+func (res *Reservation) Commit(actualCost int) {
+	res.settle(context.Background(), actualCost)
+}
+
+// CommitContext - same as Commit, tracing under the given context
+func (res *Reservation) CommitContext(ctx context.Context, actualCost int) {
+	res.settle(ctx, actualCost)
+}
+
+// Cancel - gives the whole estimate back
+func (res *Reservation) Cancel() {
+	res.settle(context.Background(), 0)
+}
+
+// CancelContext - same as Cancel, tracing under the given context
+func (res *Reservation) CancelContext(ctx context.Context) {
+	res.settle(ctx, 0)
+}
+
+func (res *Reservation) settle(ctx context.Context, actualCost int) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if res.settled {
+		return
+	}
+	res.settled = true
+	delta := actualCost - res.estimated
+	if delta == 0 {
+		return
+	}
+	r := res.limiter
+	ctx, span := r.tracer.Start(ctx, "gatekeeper.Settle")
+	defer span.End()
+	span.SetAttribute("estimated_cost", res.estimated)
+	span.SetAttribute("actual_cost", actualCost)
+	store := r.storeFor(ctx)
+	now := r.clock.Now()
+	for _, counter := range res.counters {
+		if counter.refunded {
+			// nothing of the estimate is left on it
+			continue
+		}
+		if now.Before(counter.windowEnd) {
+			if delta > 0 {
+				store.IncrByAndGet(counter.tracker, delta)
+			} else {
+				store.DecrByAndGet(counter.tracker, -delta)
+			}
+		} else if delta > 0 {
+			current := res.inst
+			current.timestamp = time.Time{}
+			store.IncrByAndGet(r.getTracker(current, counter.limit), delta)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"sort"
+)
+
+// clientRuleKey - client rules are indexed by the resource and the subject of the rule they override,
+// so that an event only ever looks at the handful of overrides that can apply to it
+type clientRuleKey struct {
+	resourceId string
+	scope      Scope
+	subject    string
+}
+
+// overridableScopes - scopes whose rules can have per client overrides
+var overridableScopes = []Scope{SCOPE_API_KEY, SCOPE_CLIENT, SCOPE_ORG}
+
+func (r *ApiRateLimiter) indexClientRule(clr ClientRule) {
+	cmr, _ := r.getCommonRuleById(clr.overridenCommonRuleId)
+	key := clientRuleKey{resourceId: cmr.resourceId, scope: cmr.scope, subject: clr.clientId}
+	r.clientRulesIdx[key] = append(r.clientRulesIdx[key], clr)
+}
+
+func (r *ApiRateLimiter) unindexClientRule(clr ClientRule) {
+	cmr, _ := r.getCommonRuleById(clr.overridenCommonRuleId)
+	key := clientRuleKey{resourceId: cmr.resourceId, scope: cmr.scope, subject: clr.clientId}
+	remaining := []ClientRule{}
+	for _, indexed := range r.clientRulesIdx[key] {
+		if indexed.id != clr.id {
+			remaining = append(remaining, indexed)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(r.clientRulesIdx, key)
+	} else {
+		r.clientRulesIdx[key] = remaining
+	}
+}
+
+// reindex - rebuilds every index from the common rules (in their original order) and the client rules.
+// Only needed when common rules change, as that can move the client rules overriding them.
+func (r *ApiRateLimiter) reindex() {
+	r.commonRulesIdxById = make(map[string]CommonRule)
+	r.commonRulesIdxByResourceId = make(map[string][]CommonRule)
+	r.clientRulesIdx = make(map[clientRuleKey][]ClientRule)
+	for _, cmr := range r.cmrules {
+		r.commonRulesIdxById[cmr.id] = cmr
+		r.commonRulesIdxByResourceId[cmr.resourceId] = append(r.commonRulesIdxByResourceId[cmr.resourceId], cmr)
+	}
+	for _, clr := range r.sortedClientRules() {
+		r.indexClientRule(clr)
+	}
+}
+
+// sortedClientRules - the client rules by id
+func (r *ApiRateLimiter) sortedClientRules() []ClientRule {
+	ids := make([]string, 0, len(r.clientRulesIdxById))
+	for id := range r.clientRulesIdxById {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	clrs := make([]ClientRule, 0, len(ids))
+	for _, id := range ids {
+		clrs = append(clrs, r.clientRulesIdxById[id])
+	}
+	return clrs
+}
+
+// AddCommonRules - adds the given rules, replacing the existing ones with the same id.
+// Nothing is applied if any of them is invalid, or if a client rule overriding them would no longer be valid.
+func (r *ApiRateLimiter) AddCommonRules(cmrs []CommonRule) error {
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	updated := make(map[string]CommonRule)
+	for _, cmr := range cmrs {
+		if err := cmr.validate(); err != nil {
+			return err
+		}
+		updated[cmr.id] = cmr
+	}
+	if len(updated) != len(cmrs) {
+		return fmt.Errorf("duplicate rule ids in %d rules", len(cmrs))
+	}
+	merged := []CommonRule{}
+	for _, cmr := range r.cmrules {
+		if replacement, ok := updated[cmr.id]; ok {
+			merged = append(merged, replacement)
+			delete(updated, cmr.id)
+		} else {
+			merged = append(merged, cmr)
+		}
+	}
+	for _, cmr := range cmrs {
+		if _, ok := updated[cmr.id]; ok {
+			merged = append(merged, cmr)
+		}
+	}
+	if _, _, errs := validRules(merged, r.sortedClientRules()); len(errs) > 0 {
+		return errs[0]
+	}
+	r.cmrules = merged
+	r.reindex()
+	return nil
+}
+
+// RemoveCommonRules - removes the given rules, along with the client rules overriding them
+func (r *ApiRateLimiter) RemoveCommonRules(ids ...string) {
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	removed := make(map[string]bool)
+	for _, id := range ids {
+		removed[id] = true
+	}
+	remaining := []CommonRule{}
+	for _, cmr := range r.cmrules {
+		if !removed[cmr.id] {
+			remaining = append(remaining, cmr)
+		}
+	}
+	for id, clr := range r.clientRulesIdxById {
+		if removed[clr.overridenCommonRuleId] {
+			delete(r.clientRulesIdxById, id)
+		}
+	}
+	r.cmrules = remaining
+	r.reindex()
+}
+
+// AddClientRules - adds the given overrides, replacing the existing ones with the same id.
+// Nothing is applied if any of them is invalid.
+func (r *ApiRateLimiter) AddClientRules(clrs []ClientRule) error {
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	for _, clr := range clrs {
+		if err := clr.validate(r.commonRulesIdxById); err != nil {
+			return err
+		}
+	}
+	for _, clr := range clrs {
+		if existing, ok := r.clientRulesIdxById[clr.id]; ok {
+			r.unindexClientRule(existing)
+		}
+		r.clientRulesIdxById[clr.id] = clr
+		r.indexClientRule(clr)
+	}
+	return nil
+}
+
+// RemoveClientRules - removes the given overrides, the common rules apply to those clients again
+func (r *ApiRateLimiter) RemoveClientRules(ids ...string) {
+	r.rulesLock.Lock()
+	defer r.rulesLock.Unlock()
+	for _, id := range ids {
+		if existing, ok := r.clientRulesIdxById[id]; ok {
+			r.unindexClientRule(existing)
+			delete(r.clientRulesIdxById, id)
+		}
+	}
+}
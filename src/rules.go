@@ -0,0 +1,161 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"time"
+
+	"./cache"
+	"./timeslice"
+)
+
+// Algorithm - how a rule turns the counts recorded against it into a decision
+type Algorithm int
+
+const (
+	ALGO_DEFAULT        Algorithm = iota // fixed window for common rules, inherited by client rules
+	ALGO_FIXED_WINDOW                    // counts reset at the end of every interval
+	ALGO_SLIDING_WINDOW                  // the previous interval is weighed in by how much of it still overlaps
+	ALGO_TOKEN_BUCKET                    // refills at quota per interval, holding at most burst units
+)
+
+// Mode - whether a rule rejects the events breaching it
+type Mode int
+
+const (
+	MODE_DEFAULT Mode = iota // enforce for common rules, inherited by client rules
+	MODE_ENFORCE
+	MODE_SHADOW // count and report breaches, but never reject
+)
+
+// replaces - whether the client rule takes the place of the common rule it overrides. A shadow override
+// of an enforced rule only runs alongside it, so that the client stays protected while it is tried out.
+func (clr ClientRule) replaces(cmr CommonRule) bool {
+	return clr.merge(cmr).mode != MODE_SHADOW || cmr.mode == MODE_SHADOW
+}
+
+// merge - the effective rule for a client: the common rule with every parameter the client rule sets
+// replacing the common one. The quota is always taken from the client rule; interval, algorithm and
+// burst and mode are only replaced when set (non zero). Descriptors, scope and resource are never overridden.
+func (clr ClientRule) merge(cmr CommonRule) CommonRule {
+	effective := cmr
+	effective.id = clr.id
+	effective.quota = clr.quota
+	if clr.interval > 0 {
+		effective.interval = clr.interval
+	}
+	if clr.algorithm != ALGO_DEFAULT {
+		effective.algorithm = clr.algorithm
+	}
+	if clr.burst > 0 {
+		effective.burst = clr.burst
+	}
+	if clr.mode != MODE_DEFAULT {
+		effective.mode = clr.mode
+	}
+	return effective
+}
+
+func (cmr CommonRule) validate() error {
+	if cmr.interval <= 0 {
+		return fmt.Errorf("rule %s: interval must be positive, got %d", cmr.id, cmr.interval)
+	}
+	if cmr.quota < 0 {
+		return fmt.Errorf("rule %s: quota can't be negative, got %d", cmr.id, cmr.quota)
+	}
+	if cmr.algorithm < ALGO_DEFAULT || cmr.algorithm > ALGO_TOKEN_BUCKET {
+		return fmt.Errorf("rule %s: unknown algorithm %d", cmr.id, cmr.algorithm)
+	}
+	if cmr.mode < MODE_DEFAULT || cmr.mode > MODE_SHADOW {
+		return fmt.Errorf("rule %s: unknown mode %d", cmr.id, cmr.mode)
+	}
+	if cmr.algorithm == ALGO_TOKEN_BUCKET && (cmr.burst <= 0 || cmr.quota == 0) {
+		return fmt.Errorf("rule %s: token bucket needs a positive quota and burst", cmr.id)
+	}
+	return nil
+}
+
+// ValidateRules - checks every rule, and every client rule merged with the common rule it overrides
+func ValidateRules(cmrs []CommonRule, clrs []ClientRule) error {
+	_, _, errs := validRules(cmrs, clrs)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (clr ClientRule) validate(commonRules map[string]CommonRule) error {
+	cmr, ok := commonRules[clr.overridenCommonRuleId]
+	if !ok {
+		return fmt.Errorf("client rule %s: overrides unknown rule %s", clr.id, clr.overridenCommonRuleId)
+	}
+	if cmr.scope == SCOPE_GLOBAL {
+		return fmt.Errorf("client rule %s: global rule %s can't be overridden per client", clr.id, cmr.id)
+	}
+	if clr.interval < 0 || clr.burst < 0 {
+		return fmt.Errorf("client rule %s: interval and burst can't be negative", clr.id)
+	}
+	return clr.merge(cmr).validate()
+}
+
+// validRules - splits out the rules that fail validation, so that one bad override doesn't take the others down
+func validRules(cmrs []CommonRule, clrs []ClientRule) ([]CommonRule, []ClientRule, []error) {
+	errs := []error{}
+	validCommon := []CommonRule{}
+	byId := make(map[string]CommonRule)
+	for _, cmr := range cmrs {
+		if _, ok := byId[cmr.id]; ok {
+			errs = append(errs, fmt.Errorf("rule %s: duplicate id", cmr.id))
+			continue
+		}
+		if err := cmr.validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		byId[cmr.id] = cmr
+		validCommon = append(validCommon, cmr)
+	}
+	validClient := []ClientRule{}
+	for _, clr := range clrs {
+		if err := clr.validate(byId); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		validClient = append(validClient, clr)
+	}
+	return validCommon, validClient, errs
+}
+
+// toLimit - resolves the algorithm of an effective rule into the window and capacity to check.
+// The token bucket is approximated with a sliding window that takes burst/quota of the interval
+// to refill, down to the millisecond, which keeps the long run rate at quota per interval and caps
+// bursts at burst units, while only needing counters that add up across hosts.
+func (cmr CommonRule) toLimit(inst Event) limit {
+	interval := time.Duration(cmr.interval) * time.Second
+	l := limit{ruleId: cmr.id, quota: cmr.quota, window: interval, scope: cmr.scope, dimensions: cmr.dimensions(inst), shadow: cmr.mode == MODE_SHADOW}
+	switch cmr.algorithm {
+	case ALGO_SLIDING_WINDOW:
+		l.sliding = true
+	case ALGO_TOKEN_BUCKET:
+		l.sliding = true
+		if cmr.quota <= 0 || cmr.burst <= 0 {
+			// nothing refills. rules failing validation never get here, but must not take the request path down
+			l.quota = 0
+			return l
+		}
+		l.quota = cmr.burst
+		l.window = (time.Duration(cmr.burst) * interval / time.Duration(cmr.quota)).Truncate(time.Millisecond)
+		if l.window < time.Millisecond {
+			l.window = time.Millisecond
+		}
+	}
+	return l
+}
+
+// slidingCount - estimates the usage over the last window from the current and the previous one
+func (r *ApiRateLimiter) slidingCount(store cache.Store, inst Event, l limit, current int) int {
+	now := r.eventTime(inst)
+	// IncrByAndGet with 0 only reads the previous window's count
+	previous := store.IncrByAndGet(r.getTrackerAt(now.Add(-l.window), inst, l), 0)
+	overlap := float64(timeslice.TimeLeftInWindowFor(now, l.window)) / float64(l.window)
+	return current + int(float64(previous)*overlap)
+}
@@ -28,7 +28,11 @@ func lcm64(a, b int) int64 {
 }
 
 func GetTimeWindow(interval int) string {
-	now := time.Now()
+	return GetTimeWindowAt(time.Now(), interval)
+}
+
+// GetTimeWindowAt - same as GetTimeWindow, but for the given instant instead of the wall clock
+func GetTimeWindowAt(now time.Time, interval int) string {
 	unix := now.Unix()
 	epoch := now.Unix()
 
@@ -44,3 +48,30 @@ func GetTimeWindow(interval int) string {
 	windowStr := time.Unix(currentWindow, 0).Format("15:04:05") // we don't need the date part
 	return windowStr
 }
+
+// TimeLeftInWindow - returns how long the window containing the given instant remains open
+func TimeLeftInWindow(now time.Time, interval int) time.Duration {
+	windowEnd := time.Unix(now.Unix()-now.Unix()%int64(interval)+int64(interval), 0)
+	return windowEnd.Sub(now)
+}
+
+// GetTimeWindowFor - same as GetTimeWindowAt, for windows of any length down to a millisecond. Windows of
+// whole seconds are the ones GetTimeWindowAt gives, shorter ones are aligned on the epoch
+func GetTimeWindowFor(now time.Time, window time.Duration) string {
+	if window%time.Second == 0 {
+		return GetTimeWindowAt(now, int(window/time.Second))
+	}
+	millis := window.Milliseconds()
+	start := now.UnixMilli() - now.UnixMilli()%millis
+	return time.UnixMilli(start).Format("15:04:05.000")
+}
+
+// TimeLeftInWindowFor - same as TimeLeftInWindow, for windows of any length down to a millisecond
+func TimeLeftInWindowFor(now time.Time, window time.Duration) time.Duration {
+	if window%time.Second == 0 {
+		return TimeLeftInWindow(now, int(window/time.Second))
+	}
+	millis := window.Milliseconds()
+	end := time.UnixMilli(now.UnixMilli() - now.UnixMilli()%millis + millis)
+	return end.Sub(now)
+}
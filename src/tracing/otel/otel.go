@@ -0,0 +1,54 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"../../tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ramanathanrv/go-throttler"
+
+// Tracer - exports the limiter's spans through OpenTelemetry:
+//
+//	tracer := otel.NewTracer(otelsdk.GetTracerProvider())
+//	limiter := NewApiRateLimiterWithConfig(cmrs, clrs, &LimiterConfig{StoreType: STORE_REDIS, Tracer: tracer})
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer - creates the spans with a tracer from the given provider
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(instrumentationName)}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, tracing.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &Span{span: span}
+}
+
+// Span - wraps an OpenTelemetry span
+type Span struct {
+	span trace.Span
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	case []string:
+		s.span.SetAttributes(attribute.StringSlice(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s *Span) End() {
+	s.span.End()
+}
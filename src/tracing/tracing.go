@@ -0,0 +1,35 @@
+package tracing
+
+import "context"
+
+// Tracer - starts the spans around the limiter's decisions and its store calls.
+// This package has no dependencies; plug in an implementation such as tracing/otel to export them.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span - a unit of traced work. Values are strings, ints, bools or string slices
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// Nop - traces nothing. Used when no tracer is configured
+type Nop struct{}
+
+type nopSpan struct{}
+
+func (Nop) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) End()                                       {}
+
+// OrNop - returns the given tracer, falling back to Nop when it is nil
+func OrNop(t Tracer) Tracer {
+	if t == nil {
+		return Nop{}
+	}
+	return t
+}
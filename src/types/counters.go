@@ -0,0 +1,145 @@
+package types
+
+// GCounter - a grow-only counter shared by several nodes. Each node only adds to its own entry, and merging
+// takes the highest of every entry, so that replicas having seen the same updates hold the same counts
+// whatever the order they came in, their duplicates and how they were grouped into merges
+type GCounter struct {
+	counts map[string]int
+}
+
+// PNCounter - a counter that can also go down, as a pair of GCounters: one of the increments, one of the decrements
+type PNCounter struct {
+	p *GCounter
+	n *GCounter
+}
+
+// NewGCounter - returns a new instance of the GCounter
+func NewGCounter() *GCounter {
+	return &GCounter{counts: make(map[string]int)}
+}
+
+// Incr - adds to the node's entry. Negative amounts are ignored, the counter only grows
+func (g *GCounter) Incr(node string, by int) {
+	if by > 0 {
+		g.counts[node] += by
+	}
+}
+
+// Get - the node's entry
+func (g *GCounter) Get(node string) int {
+	return g.counts[node]
+}
+
+// Value - the sum of the entries of every node
+func (g *GCounter) Value() int {
+	total := 0
+	for _, count := range g.counts {
+		total += count
+	}
+	return total
+}
+
+// MergeEntry - takes in the node's entry as another replica has it
+func (g *GCounter) MergeEntry(node string, count int) {
+	if count > g.counts[node] {
+		g.counts[node] = count
+	}
+}
+
+// Merge - takes in every entry of the other replica
+func (g *GCounter) Merge(other *GCounter) {
+	for node, count := range other.counts {
+		g.MergeEntry(node, count)
+	}
+}
+
+// Delete - forgets the node. Unlike the other operations it does not commute with merges: a replica that
+// has yet to see the deletion brings the entry back, so it is only for nodes that are not coming back
+func (g *GCounter) Delete(node string) {
+	delete(g.counts, node)
+}
+
+// Entries - a copy of the entries, by node
+func (g *GCounter) Entries() map[string]int {
+	entries := make(map[string]int, len(g.counts))
+	for node, count := range g.counts {
+		entries[node] = count
+	}
+	return entries
+}
+
+// NewPNCounter - returns a new instance of the PNCounter
+func NewPNCounter() *PNCounter {
+	return &PNCounter{p: NewGCounter(), n: NewGCounter()}
+}
+
+func (c *PNCounter) Incr(node string, by int) {
+	c.p.Incr(node, by)
+}
+
+func (c *PNCounter) Decr(node string, by int) {
+	c.n.Incr(node, by)
+}
+
+// Value - the increments of every node, less their decrements
+func (c *PNCounter) Value() int {
+	return c.p.Value() - c.n.Value()
+}
+
+// NodeValue - the node's own contribution to the value
+func (c *PNCounter) NodeValue(node string) int {
+	return c.p.Get(node) - c.n.Get(node)
+}
+
+// Entry - the increments and decrements of the node
+func (c *PNCounter) Entry(node string) (int, int) {
+	return c.p.Get(node), c.n.Get(node)
+}
+
+// MergeEntry - takes in the node's increments and decrements as another replica has them
+func (c *PNCounter) MergeEntry(node string, increments int, decrements int) {
+	c.p.MergeEntry(node, increments)
+	c.n.MergeEntry(node, decrements)
+}
+
+// Merge - takes in every entry of the other replica
+func (c *PNCounter) Merge(other *PNCounter) {
+	c.p.Merge(other.p)
+	c.n.Merge(other.n)
+}
+
+// Delete - forgets the node, with the same caveat as GCounter.Delete
+func (c *PNCounter) Delete(node string) {
+	c.p.Delete(node)
+	c.n.Delete(node)
+}
+
+// Has - whether the node has an entry
+func (c *PNCounter) Has(node string) bool {
+	_, ok := c.p.counts[node]
+	return ok
+}
+
+// Copy - an independent replica with the same entries
+func (c *PNCounter) Copy() *PNCounter {
+	copied := NewPNCounter()
+	copied.Merge(c)
+	return copied
+}
+
+// Equal - whether both replicas hold the same entries
+func (c *PNCounter) Equal(other *PNCounter) bool {
+	return equalEntries(c.p.counts, other.p.counts) && equalEntries(c.n.counts, other.n.counts)
+}
+
+func equalEntries(a map[string]int, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for node, count := range a {
+		if other, ok := b[node]; !ok || other != count {
+			return false
+		}
+	}
+	return true
+}
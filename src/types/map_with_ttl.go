@@ -2,13 +2,17 @@ package types
 
 import (
   "fmt"
+  "strings"
   "time"
   // "reflect"
+
+  "../clock"
 )
 
 type Map struct {
   store map[string]string
   ttlStore map[string]time.Time
+  clock clock.Clock
 }
 
 type ResultCode int
@@ -24,11 +28,16 @@ type Result struct {
 
 func (m *Map) hasExpired(originalKey string) bool {
   ttlValue := m.ttlStore[ttlKey(originalKey)]
-  return time.Now().After(ttlValue)
+  return !m.clock.Now().Before(ttlValue)
 }
 
 func NewMap() *Map {
-  return &Map{store : make(map[string]string), ttlStore : make(map[string]time.Time)}
+  return NewMapWithClock(clock.NewSystemClock())
+}
+
+// NewMapWithClock - returns a Map whose expiry is judged against the given clock
+func NewMapWithClock(clk clock.Clock) *Map {
+  return &Map{store : make(map[string]string), ttlStore : make(map[string]time.Time), clock : clk}
 }
 
 func ttlKey(key string) string {
@@ -38,7 +47,7 @@ func ttlKey(key string) string {
 func (m *Map) Put(key string, value string, duration time.Duration) {
   // we need to make two entries
   m.store[key] = value
-  m.ttlStore[ttlKey(key)] = time.Now().Add(duration)
+  m.ttlStore[ttlKey(key)] = m.clock.Now().Add(duration)
 }
 
 func (m *Map) Get(key string) (string, ResultCode) {
@@ -56,3 +65,19 @@ func (m *Map) Get(key string) (string, ResultCode) {
     return "", MISS
   }
 }
+
+func (m *Map) Delete(key string) {
+  delete(m.store, key)
+  delete(m.ttlStore, ttlKey(key))
+}
+
+// Keys - returns the keys starting with the given prefix that haven't expired yet
+func (m *Map) Keys(prefix string) []string {
+  keys := []string{}
+  for key := range m.store {
+    if strings.HasPrefix(key, prefix) && !m.hasExpired(key) {
+      keys = append(keys, key)
+    }
+  }
+  return keys
+}
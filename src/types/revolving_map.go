@@ -1,9 +1,13 @@
 package types
 
 import (
-	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"../clock"
+	"../logging"
 )
 
 type mapPtr int
@@ -15,41 +19,71 @@ const (
 	mapB
 )
 
+func (p mapPtr) String() string {
+	if p == mapA {
+		return "A"
+	}
+	return "B"
+}
+
 type RevolvingMap struct {
 	mapA            map[interface{}]interface{}
 	mapB            map[interface{}]interface{}
 	lastCleaned     mapPtr
 	maxTTL          time.Duration
 	cleanupInterval time.Duration
+	clock           clock.Clock
+	logger          *slog.Logger
+	nextCleanup     int64 // unix nanos, accessed atomically
 }
 
-func (m *RevolvingMap) cleaner() {
-	nextTime := time.Now().Truncate(time.Second)
-	nextTime = nextTime.Add(m.cleanupInterval)
-	time.Sleep(time.Until(nextTime))
-	fmt.Println("Performing cleanup now: ", time.Now())
-	if m.lastCleaned == mapA {
-		m.mapB = make(map[interface{}]interface{})
-		fmt.Println("Cleaned up B")
-		m.lastCleaned = mapB
-	} else {
-		m.mapA = make(map[interface{}]interface{})
-		fmt.Println("Cleaned up A")
-		m.lastCleaned = mapA
+// cleanupIfDue - clears the stale half of the map once a cleanup interval has elapsed.
+// Cleanups are driven by the clock on access rather than by a sleeping goroutine,
+// so a fake clock expires data deterministically.
+func (m *RevolvingMap) cleanupIfDue() {
+	now := m.clock.Now()
+	if now.UnixNano() < atomic.LoadInt64(&m.nextCleanup) {
+		return
 	}
-	go m.cleaner()
+	lock.Lock()
+	defer lock.Unlock()
+	for next := time.Unix(0, atomic.LoadInt64(&m.nextCleanup)); !now.Before(next); next = next.Add(m.cleanupInterval) {
+		if m.lastCleaned == mapA {
+			m.mapB = make(map[interface{}]interface{})
+			m.lastCleaned = mapB
+		} else {
+			m.mapA = make(map[interface{}]interface{})
+			m.lastCleaned = mapA
+		}
+		m.logger.Debug("revolving map cleanup", "cleared", m.lastCleaned.String(), "at", now)
+		atomic.StoreInt64(&m.nextCleanup, next.Add(m.cleanupInterval).UnixNano())
+	}
+}
+
+// RevolvingMapConfig - the optional dependencies of a RevolvingMap
+type RevolvingMapConfig struct {
+	Clock  clock.Clock  // optional, defaults to the system clock. the map rotates according to it
+	Logger *slog.Logger // optional, defaults to slog.Default(). cleanups are logged at debug level
 }
 
 // NewRevolvingMap - returns a new instance of the RevolvingMap
 func NewRevolvingMap(maxTTL time.Duration) *RevolvingMap {
+	return NewRevolvingMapWithConfig(maxTTL, RevolvingMapConfig{})
+}
+
+// NewRevolvingMapWithConfig - same as NewRevolvingMap, with the dependencies in RevolvingMapConfig
+func NewRevolvingMapWithConfig(maxTTL time.Duration, config RevolvingMapConfig) *RevolvingMap {
+	clk := clock.OrSystem(config.Clock)
 	m := RevolvingMap{
 		mapA:            make(map[interface{}]interface{}),
 		mapB:            make(map[interface{}]interface{}),
 		maxTTL:          maxTTL,
 		cleanupInterval: maxTTL + maxTTL, // set the cleanupInterval longer
 		lastCleaned:     mapA,
+		clock:           clk,
+		logger:          logging.OrDefault(config.Logger),
 	}
-	go m.cleaner()
+	m.nextCleanup = clk.Now().Truncate(time.Second).Add(m.cleanupInterval).UnixNano()
 	return &m
 }
 
@@ -59,12 +93,14 @@ func (m *RevolvingMap) GetCurrentMap() map[interface{}]interface{} {
 }
 
 func (m *RevolvingMap) GetCurrentMapWithLock() (*map[interface{}]interface{}, *sync.RWMutex) {
+	m.cleanupIfDue()
 	currentMap := m.getCurrentlyActiveMap()
 	return currentMap, &lock
 }
 
 // PutInt - puts the given integer into the map
 func (m *RevolvingMap) PutInt(key string, val int) int {
+	m.cleanupIfDue()
 	lock.Lock()
 	defer lock.Unlock()
 	m.mapA[key] = val
@@ -74,6 +110,7 @@ func (m *RevolvingMap) PutInt(key string, val int) int {
 
 // Put - generic put command to add any value to the map
 func (m *RevolvingMap) Put(key string, val interface{}) interface{} {
+	m.cleanupIfDue()
 	lock.Lock()
 	defer lock.Unlock()
 	m.mapA[key] = val
@@ -83,6 +120,7 @@ func (m *RevolvingMap) Put(key string, val interface{}) interface{} {
 
 // GetInt - gets the value as int after applying type assertion
 func (m *RevolvingMap) GetInt(key string) (int, bool) {
+	m.cleanupIfDue()
 	currentMap := m.getCurrentlyActiveMap()
 	lock.RLock()
 	defer lock.RUnlock()
@@ -95,8 +133,18 @@ func (m *RevolvingMap) GetInt(key string) (int, bool) {
 	return -1, false
 }
 
+// Delete - removes the key from both halves of the map
+func (m *RevolvingMap) Delete(key string) {
+	m.cleanupIfDue()
+	lock.Lock()
+	defer lock.Unlock()
+	delete(m.mapA, key)
+	delete(m.mapB, key)
+}
+
 // Get - generic Get command to read any value from the map
 func (m *RevolvingMap) Get(key string) (interface{}, bool) {
+	m.cleanupIfDue()
 	lock.RLock()
 	defer lock.RUnlock()
 	currentMap := m.getCurrentlyActiveMap()
@@ -114,6 +162,7 @@ func (m *RevolvingMap) getCurrentlyActiveMap() *map[interface{}]interface{} {
 
 // Keys - returns the keys in the map as an array
 func (m *RevolvingMap) Keys() []interface{} {
+	m.cleanupIfDue()
 	currentMap := m.getCurrentlyActiveMap()
 	lock.RLock()
 	defer lock.RUnlock()
@@ -123,3 +172,12 @@ func (m *RevolvingMap) Keys() []interface{} {
 	}
 	return keys
 }
+
+// Len - returns the number of keys in the active map
+func (m *RevolvingMap) Len() int {
+	m.cleanupIfDue()
+	currentMap := m.getCurrentlyActiveMap()
+	lock.RLock()
+	defer lock.RUnlock()
+	return len(*currentMap)
+}